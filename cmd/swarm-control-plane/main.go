@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	streaming "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/go-acme/lego/v4/lego"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/internal"
 	internalLogger "github.com/nstapelbroek/envoy-swarm-control-plane/internal/logger"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/acme"
@@ -16,6 +19,7 @@ import (
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/logger"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/provider"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/provider/swarm"
+	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/provider/swarm/converting"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/provider/tls"
 	tlsstorage "github.com/nstapelbroek/envoy-swarm-control-plane/pkg/provider/tls/storage"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/snapshot"
@@ -28,18 +32,35 @@ var (
 	leTermsAccepted  bool
 	acmeLocal        bool
 	xdsPort          uint
+	trustedHops      uint
 	acmePort         string
+	acmeTLSPort      string
 	ingressNetwork   string
 	xdsClusterName   string
 	acmeClusterName  string
+	acmeTLSCluster   string
 	acmeEmail        string
 	storagePath      string
 	storageEndpoint  string
 	storageBucket    string
 	storageAccessKey string
 	storageSecretKey string
+	rateLimitAddress string
+	rateLimitDomain  string
+	dnsProvider      string
+	dnsResolvers     string
+	acmeDirectoryURL string
+	acmeEABKid       string
+	acmeEABHmac      string
+	acmeCABundle     string
+	acmeIssuers      string
+	acmeIssuersEAB   string
+	jwksTrustedCA    string
 )
 
+// rateLimitClusterName is the static cluster that the control plane adds for the global ratelimit service
+const rateLimitClusterName = "global_ratelimit"
+
 func init() {
 	// Required arguments with defaults shipped in the yaml
 	const defaultXDSPort = 9876
@@ -50,19 +71,44 @@ func init() {
 	flag.StringVar(&xdsClusterName, "xds-cluster", "control_plane", "Name of the cluster your envoy instances are contacting for ADS/SDS")
 	flag.StringVar(&acmeClusterName, "acme-cluster", "control_plane_acme", "Name of the cluster your envoy instances are proxying for ACME HTTP-01 challenges")
 
+	// Optional arguments for TLS-ALPN-01 challenges, for edges where only port 443 is reachable
+	flag.StringVar(&acmeTLSPort, "acme-tls-port", "", "The port where envoy will proxy TLS-ALPN-01 challenges towards, leave empty to disable the challenge")
+	flag.StringVar(&acmeTLSCluster, "acme-tls-cluster", "control_plane_acme_tls", "Name of the cluster your envoy instances are proxying for ACME TLS-ALPN-01 challenges")
+
 	// Required arguments for lets encrypt
 	flag.StringVar(&acmeEmail, "acme-email", "", "When registering for LetsEncrypt certificates this e-mail will be used for the account")
 	flag.BoolVar(&leTermsAccepted, "acme-accept-terms", false, "When registering for LetsEncrypt certificates this e-mail will be used for the account")
 
+	// Optional arguments for another ACME CA than LetsEncrypt
+	flag.StringVar(&acmeDirectoryURL, "acme-directory-url", "", "Directory URL of the ACME CA, defaults to LetsEncrypt production")
+	flag.StringVar(&acmeEABKid, "acme-eab-kid", "", "Key identifier for the external account binding that some CA's require")
+	flag.StringVar(&acmeEABHmac, "acme-eab-hmac", "", "Base64 url encoded HMAC key for the external account binding that some CA's require")
+	flag.StringVar(&acmeCABundle, "acme-ca-bundle", "", "PEM file with extra CA certificates to trust when connecting to the ACME CA")
+
+	flag.StringVar(&acmeIssuers, "acme-issuers", "", "Comma separated name=directory-url list of extra ACME CA's that services can select with the envoy.tls.issuer label")
+	flag.StringVar(&acmeIssuersEAB, "acme-issuers-eab", "", "Comma separated name=kid:hmac list of external account bindings for the extra ACME CA's")
+
+	// Optional arguments for DNS-01 challenges, the provider credentials are read from its environment variables
+	flag.StringVar(&dnsProvider, "acme-dns-provider", "", "Name of the DNS provider (cloudflare, digitalocean, exec, httpreq, rfc2136 or route53) that solves the challenges of all domains through DNS-01, replacing HTTP-01 and TLS-ALPN-01")
+	flag.StringVar(&dnsResolvers, "acme-dns-resolvers", "", "Comma separated host:port list of resolvers that are used to check DNS-01 propagation")
+
 	// Optional arguments to store certificates in a object tls_storage
 	flag.StringVar(&storageEndpoint, "storage-endpoint", "certs3.amazonaws.com", "Host endpoint for the certs3 certificate tls_storage")
 	flag.StringVar(&storageBucket, "storage-bucket", "", "Bucket name of the certificate tls_storage")
 	flag.StringVar(&storageAccessKey, "storage-access-key", "", "Access key to authenticate at the certificate tls_storage")
 	flag.StringVar(&storageSecretKey, "storage-secret-key", "", "Secret key to authenticate at the certificate tls_storage")
 
+	// Optional arguments for a global ratelimit service (https://github.com/envoyproxy/ratelimit)
+	flag.StringVar(&rateLimitAddress, "ratelimit-address", "", "The host:port of a gRPC ratelimit service, enables the route.ratelimit.descriptors labels")
+	flag.StringVar(&rateLimitDomain, "ratelimit-domain", "envoy-swarm", "The domain of the ratelimit service configuration that contains your limits")
+
+	// Optional argument to verify the hosts that JWT signing keys are fetched from
+	flag.StringVar(&jwksTrustedCA, "jwks-trusted-ca", converting.DefaultTrustedCA, "CA bundle on the envoy instances that the certificates of route.jwt.jwks-uri hosts are verified with")
+
 	// Remainder flags
 	flag.BoolVar(&debug, "debug", false, "Use debug logging")
 	flag.BoolVar(&acmeLocal, "acme-local", false, "Use a local acme server setup for development")
+	flag.UintVar(&trustedHops, "xff-trusted-hops", 0, "The amount of proxies in front of envoy that append to X-Forwarded-For, used to determine the client address")
 }
 
 func main() {
@@ -103,6 +149,7 @@ func createWatchers(ctx context.Context, acmeIntegration *acme.Integration) chan
 		go watcher.ForLetsEncrypt(acmeIntegration, log).Start(ctx, UpdateEvents)
 	}
 	go watcher.ForSwarmEvent(log).Start(ctx, UpdateEvents)
+	go watcher.ForSwarmTask(log).Start(ctx, UpdateEvents)
 	go watcher.CreateInitialStartupEvent(UpdateEvents)
 
 	return UpdateEvents
@@ -122,25 +169,137 @@ func setupTLS() (sdsProvider provider.SDS, acmeIntegration *acme.Integration) {
 		return sdsProvider, acmeIntegration
 	}
 
-	// Due to complexity with registration and persisting state, we'll use a builder to split init logic
-	acmeBuilder := client.NewAcmeBuilder(fileStorage).ForAccount(acmeEmail).WithHTTP01Challenge(acmePort)
-	if acmeLocal {
-		acmeBuilder.ForLocalDevelopment()
+	acmeLogger := internalLogger.Instance().WithFields(logger.Fields{"area": "acme"})
+	acmeBuilder, err := newAcmeBuilder(fileStorage)
+	if err != nil {
+		acmeLogger.Warnf("ACME integration disabled due to an initialisation error: %s", err.Error())
+		return sdsProvider, acmeIntegration
+	}
+
+	if acmeDirectoryURL != "" {
+		acmeBuilder.WithDirectoryURL(acmeDirectoryURL)
+	}
+
+	if acmeEABKid != "" || acmeEABHmac != "" {
+		acmeBuilder.WithExternalAccountBinding(acmeEABKid, acmeEABHmac)
 	}
 
 	acmeClient, err := acmeBuilder.Build()
-	acmeLogger := internalLogger.Instance().WithFields(logger.Fields{"area": "acme"})
 	if err != nil {
 		acmeLogger.Warnf("ACME integration disabled due to an initialisation error: %s", err.Error())
 		return sdsProvider, acmeIntegration
 	}
 
-	return sdsProvider, acme.NewIntegration(
+	acmeIntegration = acme.NewIntegration(
 		acmeClient,
 		acmeClusterName,
 		certificateStorage,
 		acmeLogger,
 	)
+	if dnsProvider != "" {
+		acmeLogger.Infof("ACME challenges of all domains are solved through DNS-01 with the %s provider", dnsProvider)
+		acmeIntegration.WithDNS01Challenge()
+	} else if acmeTLSPort != "" {
+		acmeIntegration.WithTLSALPN01Challenge(acmeTLSCluster)
+	}
+
+	// Named issuers share the account and challenge settings, services select them with the envoy.tls.issuer label
+	issuers, issuerBindings := splitFlagMap(acmeIssuers), splitFlagMap(acmeIssuersEAB)
+	for name := range issuerBindings {
+		if _, exists := issuers[name]; !exists {
+			acmeLogger.Warnf("ignored the external account binding of ACME issuer %s, the issuer is not configured", name)
+		}
+	}
+
+	for name, directoryURL := range issuers {
+		if name == converting.TLSIssuerACME || name == converting.TLSIssuerNone || name == converting.TLSIssuerManual {
+			acmeLogger.Warnf("skipped ACME issuer %s, the name is reserved", name)
+			continue
+		}
+
+		issuerClient, err := buildNamedIssuer(fileStorage, directoryURL, issuerBindings[name])
+		if err != nil {
+			acmeLogger.Warnf("skipped ACME issuer %s due to an initialisation error: %s", name, err.Error())
+			continue
+		}
+
+		acmeIntegration.AddIssuer(name, issuerClient)
+	}
+
+	return sdsProvider, acmeIntegration
+}
+
+// newAcmeBuilder applies the settings that every ACME issuer shares
+func newAcmeBuilder(fileStorage storage.Storage) (*client.AcmeClientBuilder, error) {
+	// Due to complexity with registration and persisting state, we'll use a builder to split init logic
+	acmeBuilder := client.NewAcmeBuilder(fileStorage).ForAccount(acmeEmail)
+	if acmeLocal {
+		acmeBuilder.ForLocalDevelopment()
+	}
+
+	if acmeCABundle != "" {
+		acmeBuilder.WithCABundle(acmeCABundle)
+	}
+
+	// DNS-01 doesn't depend on traffic reaching the edge, so it solves the challenges of all domains when configured
+	if dnsProvider != "" {
+		provider, err := client.NewDNSProvider(dnsProvider)
+		if err != nil {
+			return nil, err
+		}
+
+		return acmeBuilder.WithDNS01Challenge(provider, splitFlagList(dnsResolvers)...), nil
+	}
+
+	acmeBuilder.WithHTTP01Challenge(acmePort)
+	if acmeTLSPort != "" {
+		acmeBuilder.WithTLSALPN01Challenge(acmeTLSPort)
+	}
+
+	return acmeBuilder, nil
+}
+
+// buildNamedIssuer creates the client of an extra ACME CA, the binding is an optional kid:hmac pair
+func buildNamedIssuer(fileStorage storage.Storage, directoryURL, binding string) (*lego.Client, error) {
+	issuerBuilder, err := newAcmeBuilder(fileStorage)
+	if err != nil {
+		return nil, err
+	}
+
+	if binding != "" {
+		// The hmac is base64 url encoded, so the last colon always separates it from the kid
+		separator := strings.LastIndex(binding, ":")
+		if separator == -1 {
+			return nil, errors.New("the external account binding should be a kid:hmac pair")
+		}
+
+		issuerBuilder.WithExternalAccountBinding(binding[:separator], binding[separator+1:])
+	}
+
+	return issuerBuilder.WithDirectoryURL(directoryURL).Build()
+}
+
+// splitFlagMap splits a comma separated list of key=value pairs
+func splitFlagMap(value string) map[string]string {
+	items := make(map[string]string)
+	for _, item := range splitFlagList(value) {
+		if key, value, found := strings.Cut(item, "="); found {
+			items[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+		}
+	}
+
+	return items
+}
+
+// splitFlagList splits a comma separated flag value, ignoring empty items
+func splitFlagList(value string) (items []string) {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
 }
 
 // getStorage will configure the file with optional s3 extension
@@ -166,13 +325,27 @@ func setupDiscovery(snsProvider provider.SDS, acmeIntegration *acme.Integration)
 	listenerBuilder := swarm.NewListenerProvider(
 		snsProvider,
 		acmeIntegration,
-	)
+	).WithTrustedProxyHops(uint32(trustedHops))
 
-	return swarm.NewADSProvider(
+	adsLogger := internalLogger.Instance().WithFields(logger.Fields{"area": "ads-provider"})
+	adsProvider := swarm.NewADSProvider(
 		ingressNetwork,
+		swarm.NewEndpointProvider(),
 		listenerBuilder,
-		internalLogger.Instance().WithFields(logger.Fields{"area": "ads-provider"}),
-	)
+		adsLogger,
+	).WithJWKSTrustedCA(jwksTrustedCA)
+
+	if rateLimitAddress != "" {
+		rateLimitCluster, err := converting.StaticGRPCCluster(rateLimitClusterName, rateLimitAddress)
+		if err != nil {
+			adsLogger.Fatalf(err.Error())
+		}
+
+		adsProvider.AddStaticCluster(rateLimitCluster)
+		listenerBuilder.WithRateLimitService(rateLimitDomain, rateLimitClusterName)
+	}
+
+	return adsProvider
 }
 
 func waitForSignal(application context.Context) {
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,30 +16,77 @@ import (
 	tlsstorage "github.com/nstapelbroek/envoy-swarm-control-plane/pkg/provider/tls/storage"
 )
 
+// HTTP01RouteName is the route that proxies HTTP-01 challenges towards the control plane
+const HTTP01RouteName = "acme_http01_route"
+
+// DefaultIssuer is the name of the client that the integration is created with
+const DefaultIssuer = "acme"
+
 type Integration struct {
-	acmeClient      *lego.Client
+	issuers         map[string]*lego.Client
 	acmeClusterName string
 	issueBacklog    map[string][]string
 	renewalList     map[string][]string
+	vhostIssuers    map[string]string
 	mutex           sync.Mutex
 	certStorage     *tlsstorage.Certificate
 	logger          logger.Logger
+	dns01Enabled    bool
+	tlsClusterName  string
 }
 
 func NewIntegration(client *lego.Client, cluster string, certStorage *tlsstorage.Certificate, log logger.Logger) *Integration {
 	return &Integration{
-		acmeClient:      client,
+		issuers:         map[string]*lego.Client{DefaultIssuer: client},
 		acmeClusterName: cluster,
 		issueBacklog:    make(map[string][]string),
 		renewalList:     make(map[string][]string),
+		vhostIssuers:    make(map[string]string),
 		certStorage:     certStorage,
 		logger:          log,
 	}
 }
 
+// AddIssuer makes another ACME client available for vhosts, like a staging CA or a private CA
+func (i *Integration) AddIssuer(name string, client *lego.Client) *Integration {
+	i.issuers[name] = client
+
+	return i
+}
+
+// WithDNS01Challenge tells the integration that the client solves every challenge through DNS-01, which allows
+// issuing wildcard certificates and domains that don't point at the edge. Envoy won't proxy any challenges
+func (i *Integration) WithDNS01Challenge() *Integration {
+	i.dns01Enabled = true
+
+	return i
+}
+
+// WithTLSALPN01Challenge tells the integration that the client can solve TLS-ALPN-01 challenges, which envoy proxies
+// through the cluster towards the control plane
+func (i *Integration) WithTLSALPN01Challenge(cluster string) *Integration {
+	i.tlsClusterName = cluster
+
+	return i
+}
+
+// TLSALPN01ClusterName is the cluster that receives TLS-ALPN-01 challenges, empty when the challenge is not used
+func (i *Integration) TLSALPN01ClusterName() string {
+	if i.dns01Enabled {
+		return ""
+	}
+
+	return i.tlsClusterName
+}
+
 // EnableAutoRenewal will administer the current domains of the vhost to a watchlist that gets checked every day
-func (i *Integration) EnableAutoRenewal(vhost *route.VirtualHost) {
-	go i.addToRenewalList(vhost.GetDomains())
+func (i *Integration) EnableAutoRenewal(vhost *route.VirtualHost, issuer string) {
+	if _, exists := i.issuers[issuer]; !exists {
+		i.logger.WithFields(logger.Fields{"vhost": vhost.Name}).Warnf("skipped ACME renewal, the issuer %s is not configured", issuer)
+		return
+	}
+
+	go i.addToRenewalList(vhost.GetDomains(), issuer)
 }
 
 // IsScheduledForIssuing will tell if a vhost is about to partake in an ACME challenge
@@ -48,9 +96,29 @@ func (i *Integration) IsScheduledForIssuing(vhost *route.VirtualHost) bool {
 }
 
 // PrepareVhostForIssuing will add the vhost to the issue backlog and update the vhost config for any ACME challenge
-func (i *Integration) PrepareVhostForIssuing(vhost *route.VirtualHost) *route.VirtualHost {
+// It reports whether the vhost was prepared, vhosts of an unknown issuer or with unsupported domains are left as is
+func (i *Integration) PrepareVhostForIssuing(vhost *route.VirtualHost, issuer string) (_ *route.VirtualHost, prepared bool) {
+	if _, exists := i.issuers[issuer]; !exists {
+		i.logger.WithFields(logger.Fields{"vhost": vhost.Name}).Warnf("skipped ACME issuing, the issuer %s is not configured", issuer)
+		return vhost, false
+	}
+
+	if !i.canIssue(vhost.Domains) {
+		i.logger.WithFields(logger.Fields{"vhost": vhost.Name}).Warnf("skipped ACME issuing, wildcard domains require a DNS-01 challenge")
+		return vhost, false
+	}
+
+	// Prevent waiting for IssueCertificates() to complete
+	go i.addToIssueBacklog(vhost.Domains, issuer)
+
+	// DNS-01 challenges are solved without any traffic reaching the edge
+	if i.dns01Enabled {
+		i.logger.WithFields(logger.Fields{"vhost": vhost.Name}).Debugf("vhost scheduled for ACME issuing through DNS-01")
+		return vhost, true
+	}
+
 	vhost.Routes = append([]*route.Route{{
-		Name: "acme_http01_route",
+		Name: HTTP01RouteName,
 		Match: &route.RouteMatch{
 			PathSpecifier: &route.RouteMatch_Prefix{
 				Prefix: "/.well-known", // path prefix only works on first level at this moment
@@ -65,9 +133,6 @@ func (i *Integration) PrepareVhostForIssuing(vhost *route.VirtualHost) *route.Vi
 		},
 	}}, vhost.Routes...)
 
-	// Prevent waiting for IssueCertificates() to complete
-	go i.addToIssueBacklog(vhost.Domains)
-
 	// See https://github.com/envoyproxy/envoy/issues/886, Host headers with a port value cause a mismatch
 	// Unsure if this happens in the wild, but to be sure I'll update the vhost domains
 	remappedDomains := make([]string, len(vhost.Domains)*2) //nolint:gomnd // it's twice the size of the original array
@@ -79,7 +144,7 @@ func (i *Integration) PrepareVhostForIssuing(vhost *route.VirtualHost) *route.Vi
 	vhost.Domains = remappedDomains
 	i.logger.WithFields(logger.Fields{"vhost": vhost.Name}).Debugf("vhost configured for ACME issuing")
 
-	return vhost
+	return vhost, true
 }
 
 func (i *Integration) IssueCertificates() (reloadRequired bool, err error) {
@@ -93,9 +158,18 @@ func (i *Integration) IssueCertificates() (reloadRequired bool, err error) {
 	for primaryDomain := range i.issueBacklog {
 		domains := i.issueBacklog[primaryDomain]
 
+		issuer, exists := i.issuers[i.vhostIssuers[primaryDomain]]
+		if !exists {
+			err = fmt.Errorf("the issuer %s of %s is not configured", i.vhostIssuers[primaryDomain], primaryDomain)
+			i.logger.Errorf("failed issuing certificate: %s", err.Error())
+			delete(i.issueBacklog, primaryDomain)
+			continue
+		}
+
 		request := certificate.ObtainRequest{Domains: domains, Bundle: true}
-		certs, err := i.acmeClient.Certificate.Obtain(request)
-		if err != nil {
+		certs, obtainErr := issuer.Certificate.Obtain(request)
+		if obtainErr != nil {
+			err = obtainErr
 			i.logger.Errorf("failed issuing certificate: %s", err.Error())
 			delete(i.issueBacklog, primaryDomain)
 			continue
@@ -140,7 +214,7 @@ func (i *Integration) ScheduleRenewals() (reloadRequired bool) {
 
 		cert, _ := x509.ParseCertificate(pair.Certificate[0])
 		if time.Now().Add(CertificateExpiryThreshold * time.Hour).After(cert.NotAfter) {
-			go i.addToIssueBacklog(domains)
+			go i.addToIssueBacklog(domains, i.vhostIssuers[primaryDomain])
 			i.logger.Infof("queued renewal of certificate for %s", primaryDomain)
 			reloadRequired = true
 		}
@@ -149,18 +223,34 @@ func (i *Integration) ScheduleRenewals() (reloadRequired bool) {
 	return reloadRequired
 }
 
-func (i *Integration) addToRenewalList(domains []string) {
-	backlogKey := domains[0] // @see TestVhostPrimaryDomainIsFirstInDomains
-	if _, exists := i.renewalList[backlogKey]; exists {
-		return
+// canIssue tells if all domains can be validated with the configured challenges
+func (i *Integration) canIssue(domains []string) bool {
+	if i.dns01Enabled {
+		return true
+	}
+
+	for _, domain := range domains {
+		if strings.HasPrefix(domain, "*.") {
+			return false
+		}
 	}
 
+	return true
+}
+
+func (i *Integration) addToRenewalList(domains []string, issuer string) {
+	backlogKey := domains[0] // @see TestVhostPrimaryDomainIsFirstInDomains
+
+	// The issuer label can change while the certificate is still valid, the next renewal should use the new issuer
 	i.mutex.Lock()
-	i.renewalList[backlogKey] = domains
+	if _, exists := i.renewalList[backlogKey]; !exists {
+		i.renewalList[backlogKey] = domains
+	}
+	i.vhostIssuers[backlogKey] = issuer
 	i.mutex.Unlock()
 }
 
-func (i *Integration) addToIssueBacklog(domains []string) {
+func (i *Integration) addToIssueBacklog(domains []string, issuer string) {
 	backlogKey := domains[0] // @see TestVhostPrimaryDomainIsFirstInDomains
 	if _, exists := i.issueBacklog[backlogKey]; exists {
 		return
@@ -168,5 +258,6 @@ func (i *Integration) addToIssueBacklog(domains []string) {
 
 	i.mutex.Lock()
 	i.issueBacklog[backlogKey] = domains
+	i.vhostIssuers[backlogKey] = issuer
 	i.mutex.Unlock()
 }
@@ -0,0 +1,67 @@
+package acme
+
+import (
+	"testing"
+	"time"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+type discardLogger struct{}
+
+func (d *discardLogger) Debugf(_ string, _ ...interface{})        {}
+func (d *discardLogger) Infof(_ string, _ ...interface{})         {}
+func (d *discardLogger) Warnf(_ string, _ ...interface{})         {}
+func (d *discardLogger) Errorf(_ string, _ ...interface{})        {}
+func (d *discardLogger) Fatalf(_ string, _ ...interface{})        {}
+func (d *discardLogger) Panicf(_ string, _ ...interface{})        {}
+func (d *discardLogger) WithFields(_ logger.Fields) logger.Logger { return d }
+
+func TestEnableAutoRenewalSkipsUnknownIssuers(t *testing.T) {
+	integration := NewIntegration(nil, "control_plane_acme", nil, &discardLogger{})
+
+	integration.EnableAutoRenewal(&route.VirtualHost{Name: "example.com", Domains: []string{"example.com"}}, "staging")
+
+	assert.Empty(t, integration.renewalList)
+}
+
+func TestRenewalListFollowsTheIssuerOfTheVhost(t *testing.T) {
+	integration := NewIntegration(nil, "control_plane_acme", nil, &discardLogger{}).AddIssuer("staging", &lego.Client{})
+
+	integration.addToRenewalList([]string{"example.com"}, DefaultIssuer)
+	integration.addToRenewalList([]string{"example.com"}, "staging")
+
+	assert.Len(t, integration.renewalList, 1)
+	assert.Equal(t, "staging", integration.vhostIssuers["example.com"])
+}
+
+func TestIssueCertificatesFailsForUnknownIssuers(t *testing.T) {
+	integration := NewIntegration(nil, "control_plane_acme", nil, &discardLogger{})
+	integration.addToIssueBacklog([]string{"example.com"}, "staging")
+
+	reloadRequired, err := integration.IssueCertificates()
+
+	assert.False(t, reloadRequired)
+	assert.EqualError(t, err, "the issuer staging of example.com is not configured")
+	assert.Empty(t, integration.issueBacklog)
+}
+
+func TestPrepareVhostForIssuingThroughDNS01(t *testing.T) {
+	integration := NewIntegration(&lego.Client{}, "control_plane_acme", nil, &discardLogger{}).WithDNS01Challenge()
+	vhost := &route.VirtualHost{Name: "internal.example.com", Domains: []string{"internal.example.com"}}
+
+	vhost, prepared := integration.PrepareVhostForIssuing(vhost, DefaultIssuer)
+
+	assert.True(t, prepared)
+	assert.Empty(t, vhost.Routes)
+	assert.Equal(t, []string{"internal.example.com"}, vhost.Domains)
+	assert.Eventually(t, func() bool {
+		integration.mutex.Lock()
+		defer integration.mutex.Unlock()
+
+		return integration.issueBacklog["internal.example.com"] != nil
+	}, time.Second, 10*time.Millisecond)
+}
@@ -1,11 +1,23 @@
 package storage
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
-func privateKeyFileName(email string) string {
-	return fmt.Sprintf("%s-acme-privateKey.pem", email)
+func privateKeyFileName(namespace, email string) string {
+	return fmt.Sprintf("%s%s-acme-privateKey.pem", namespacePrefix(namespace), email)
 }
 
-func registrationFileName(email string) string {
-	return fmt.Sprintf("%s-acme-account-registration.json", email)
+func registrationFileName(namespace, email string) string {
+	return fmt.Sprintf("%s%s-acme-account-registration.json", namespacePrefix(namespace), email)
+}
+
+// namespacePrefix keeps files of the default CA at their original location
+func namespacePrefix(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+
+	return strings.NewReplacer("/", "_", "\\", "", ":", "_").Replace(namespace) + "-"
 }
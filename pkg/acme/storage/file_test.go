@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestFileNamesOfTheDefaultCAAreNotNamespaced(t *testing.T) {
+	assert.Equal(t, privateKeyFileName("", "you@example.com"), "you@example.com-acme-privateKey.pem")
+	assert.Equal(t, registrationFileName("", "you@example.com"), "you@example.com-acme-account-registration.json")
+}
+
+func TestFileNamesAreNamespacedPerCA(t *testing.T) {
+	assert.Equal(t, privateKeyFileName("ca.internal:9000", "you@example.com"), "ca.internal_9000-you@example.com-acme-privateKey.pem")
+	assert.Equal(t, registrationFileName("acme.zerossl.com", "you@example.com"), "acme.zerossl.com-you@example.com-acme-account-registration.json")
+}
+
+func TestFileNamesAreNamespacedPerDirectoryPath(t *testing.T) {
+	assert.Equal(t, privateKeyFileName("ca.internal/acme/acme", "you@example.com"), "ca.internal_acme_acme-you@example.com-acme-privateKey.pem")
+	assert.Equal(t, privateKeyFileName("ca.internal/acme/other", "you@example.com"), "ca.internal_acme_other-you@example.com-acme-privateKey.pem")
+}
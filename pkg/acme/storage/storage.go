@@ -6,15 +6,16 @@ import (
 
 type Account struct {
 	storage.Storage
+	Namespace string // separates accounts of different CAs, empty for the default CA
 }
 
 func (c *Account) LoadPrivateKeyAndRegistration(email string) (privateKey, registration []byte, err error) {
-	privateKey, err = c.GetFile(privateKeyFileName(email))
+	privateKey, err = c.GetFile(privateKeyFileName(c.Namespace, email))
 	if err != nil {
 		return nil, nil, err
 	}
 
-	registration, err = c.GetFile(registrationFileName(email))
+	registration, err = c.GetFile(registrationFileName(c.Namespace, email))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -23,9 +24,9 @@ func (c *Account) LoadPrivateKeyAndRegistration(email string) (privateKey, regis
 }
 
 func (c *Account) SavePrivateKeyAndRegistration(email string, privateKey, registration []byte) error {
-	if err := c.PutFile(privateKeyFileName(email), privateKey); err != nil {
+	if err := c.PutFile(privateKeyFileName(c.Namespace, email), privateKey); err != nil {
 		return err
 	}
 
-	return c.PutFile(registrationFileName(email), registration)
+	return c.PutFile(registrationFileName(c.Namespace, email), registration)
 }
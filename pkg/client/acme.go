@@ -1,9 +1,24 @@
 package client
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
 	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
 	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
 	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/providers/dns/cloudflare"
+	"github.com/go-acme/lego/v4/providers/dns/digitalocean"
+	"github.com/go-acme/lego/v4/providers/dns/exec"
+	"github.com/go-acme/lego/v4/providers/dns/httpreq"
+	"github.com/go-acme/lego/v4/providers/dns/rfc2136"
+	"github.com/go-acme/lego/v4/providers/dns/route53"
 	"github.com/go-acme/lego/v4/registration"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/acme"
 	astorage "github.com/nstapelbroek/envoy-swarm-control-plane/pkg/acme/storage"
@@ -13,7 +28,14 @@ import (
 type AcmeClientBuilder struct {
 	accountStorage      *astorage.Account
 	http01Port          string
+	tlsALPN01Port       string
+	dns01Provider       challenge.Provider
+	dns01Resolvers      []string
 	acmeEmail           string
+	directoryURL        string
+	eabKid              string
+	eabHmac             string
+	caBundlePath        string
 	forLocalDevelopment bool
 }
 
@@ -35,6 +57,44 @@ func (a *AcmeClientBuilder) WithHTTP01Challenge(port string) *AcmeClientBuilder
 	return a
 }
 
+// WithTLSALPN01Challenge is preferred over HTTP-01 when both are configured, as it only requires port 443 at the edge
+func (a *AcmeClientBuilder) WithTLSALPN01Challenge(port string) *AcmeClientBuilder {
+	a.tlsALPN01Port = port
+
+	return a
+}
+
+// WithDNS01Challenge validates all domains by creating TXT records, HTTP-01 and TLS-ALPN-01 are no longer used.
+// The resolvers are used to check if these records propagated. Leave them empty to use the system resolvers
+func (a *AcmeClientBuilder) WithDNS01Challenge(provider challenge.Provider, resolvers ...string) *AcmeClientBuilder {
+	a.dns01Provider = provider
+	a.dns01Resolvers = resolvers
+
+	return a
+}
+
+// WithDirectoryURL uses another ACME CA than LetsEncrypt, like ZeroSSL, Google Trust Services or a private step-ca
+func (a *AcmeClientBuilder) WithDirectoryURL(directoryURL string) *AcmeClientBuilder {
+	a.directoryURL = directoryURL
+
+	return a
+}
+
+// WithExternalAccountBinding links the registration to an existing account at the CA, the hmac is base64 url encoded
+func (a *AcmeClientBuilder) WithExternalAccountBinding(kid, hmac string) *AcmeClientBuilder {
+	a.eabKid = kid
+	a.eabHmac = hmac
+
+	return a
+}
+
+// WithCABundle trusts the PEM certificates in the file next to the system roots when connecting to the CA
+func (a *AcmeClientBuilder) WithCABundle(path string) *AcmeClientBuilder {
+	a.caBundlePath = path
+
+	return a
+}
+
 func (a *AcmeClientBuilder) ForLocalDevelopment() *AcmeClientBuilder {
 	a.forLocalDevelopment = true
 
@@ -43,6 +103,20 @@ func (a *AcmeClientBuilder) ForLocalDevelopment() *AcmeClientBuilder {
 
 // Build is going to validate and configure accounts, please note that this will spit errors on any failure
 func (a *AcmeClientBuilder) Build() (*lego.Client, error) {
+	if (a.eabKid == "") != (a.eabHmac == "") {
+		return nil, errors.New("external account binding requires both a kid and a hmac")
+	}
+
+	// Accounts only exist at the CA that registered them, so these are stored per custom CA
+	// The path is part of it, as one host can serve multiple directories (like step-ca provisioners)
+	if a.directoryURL != "" {
+		directory, err := url.Parse(a.directoryURL)
+		if err != nil {
+			return nil, err
+		}
+		a.accountStorage.Namespace = directory.Host + strings.TrimSuffix(directory.Path, "/")
+	}
+
 	account := acme.NewAccount(a.accountStorage, a.acmeEmail)
 	if err := account.LoadFromStorage(); err != nil {
 		account.SetNewPrivateKey()
@@ -56,12 +130,34 @@ func (a *AcmeClientBuilder) Build() (*lego.Client, error) {
 		config.Certificate.KeyType = certcrypto.RSA2048
 	}
 
+	if a.directoryURL != "" {
+		config.CADirURL = a.directoryURL
+	}
+
+	if a.caBundlePath != "" {
+		if err := a.trustCABundle(config.HTTPClient); err != nil {
+			return nil, err
+		}
+	}
+
 	client, err := lego.NewClient(config)
 	if err != nil {
 		return nil, err
 	}
 
-	if a.http01Port != "" {
+	// DNS-01 solves every challenge when configured, as its domains might not point at the edge (yet)
+	if a.dns01Provider != nil {
+		var options []dns01.ChallengeOption
+		if len(a.dns01Resolvers) > 0 {
+			options = append(options, dns01.AddRecursiveNameservers(a.dns01Resolvers))
+		}
+
+		if err = client.Challenge.SetDNS01Provider(a.dns01Provider, options...); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.http01Port != "" && a.dns01Provider == nil {
 		// The HTTP01 spec enforces challenge traffic over 80/443. Envoys in the edge will proxy it to our custom port
 		err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer("", a.http01Port))
 		if err != nil {
@@ -69,11 +165,19 @@ func (a *AcmeClientBuilder) Build() (*lego.Client, error) {
 		}
 	}
 
+	if a.tlsALPN01Port != "" && a.dns01Provider == nil {
+		// Like HTTP01, the challenge is expected on port 443 and envoys in the edge will proxy it to our custom port
+		err = client.Challenge.SetTLSALPN01Provider(tlsalpn01.NewProviderServer("", a.tlsALPN01Port))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if account.IsRegistered() {
 		return client, nil
 	}
 
-	reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	reg, err := a.register(client)
 	if err != nil {
 		return nil, err
 	}
@@ -85,3 +189,53 @@ func (a *AcmeClientBuilder) Build() (*lego.Client, error) {
 
 	return client, nil
 }
+
+func (a *AcmeClientBuilder) register(client *lego.Client) (*registration.Resource, error) {
+	if a.eabKid != "" {
+		return client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+			TermsOfServiceAgreed: true,
+			Kid:                  a.eabKid,
+			HmacEncoded:          a.eabHmac,
+		})
+	}
+
+	return client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+}
+
+func (a *AcmeClientBuilder) trustCABundle(httpClient *http.Client) error {
+	pool, err := lego.CreateCertPool([]string{a.caBundlePath}, true)
+	if err != nil {
+		return err
+	}
+
+	transport, ok := httpClient.Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig == nil {
+		return errors.New("unable to configure the CA bundle on the ACME http client")
+	}
+
+	transport.TLSClientConfig.RootCAs = pool
+
+	return nil
+}
+
+// dnsProviders is a curated set of lego DNS providers, importing all of them would pull in hundreds of modules
+// The exec and httpreq providers delegate to a script or webhook, which covers any DNS host that is missing here
+var dnsProviders = map[string]func() (challenge.Provider, error){
+	"cloudflare":   func() (challenge.Provider, error) { return cloudflare.NewDNSProvider() },
+	"digitalocean": func() (challenge.Provider, error) { return digitalocean.NewDNSProvider() },
+	"exec":         func() (challenge.Provider, error) { return exec.NewDNSProvider() },
+	"httpreq":      func() (challenge.Provider, error) { return httpreq.NewDNSProvider() },
+	"rfc2136":      func() (challenge.Provider, error) { return rfc2136.NewDNSProvider() },
+	"route53":      func() (challenge.Provider, error) { return route53.NewDNSProvider() },
+}
+
+// NewDNSProvider creates one of the supported lego DNS providers by name. Each provider reads its credentials from
+// environment variables, @see https://go-acme.github.io/lego/dns/
+func NewDNSProvider(name string) (challenge.Provider, error) {
+	newProvider, exists := dnsProviders[name]
+	if !exists {
+		return nil, fmt.Errorf("the DNS provider %s is not one of cloudflare, digitalocean, exec, httpreq, rfc2136 or route53", name)
+	}
+
+	return newProvider()
+}
@@ -11,7 +11,7 @@ import (
 )
 
 type ADS interface {
-	Provide(ctx context.Context) (clusters, listeners []types.Resource, err error)
+	Provide(ctx context.Context) (clusters, endpoints, listeners []types.Resource, err error)
 }
 
 type SDS interface {
@@ -3,23 +3,20 @@ package converting
 import (
 	"time"
 
+	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"github.com/docker/docker/api/types/swarm"
 	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
-	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	upstreamhttp "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
 )
 
-// convertService will convert swarm service definitions into validated envoy resources
+// ServiceToCluster will convert a swarm service definition and one of its label groups into a validated envoy cluster
+// The endpoints of the cluster are discovered separately (EDS) from the running tasks of the service
 func ServiceToCluster(service *swarm.Service, labels *ServiceLabel) (c *cluster.Cluster, err error) {
-	e := convertServiceToEndpoint(service, labels)
-	if err = e.Validate(); err != nil {
-		return
-	}
-
-	c = convertServiceToCluster(service, e)
+	c = convertServiceToCluster(labels.ClusterName(service.Spec.Name), labels)
 	if err = c.Validate(); err != nil {
 		return
 	}
@@ -27,44 +24,24 @@ func ServiceToCluster(service *swarm.Service, labels *ServiceLabel) (c *cluster.
 	return
 }
 
-func convertServiceToEndpoint(service *swarm.Service, labels *ServiceLabel) *endpoint.ClusterLoadAssignment {
-	return &endpoint.ClusterLoadAssignment{
-		ClusterName: service.Spec.Name,
-		Endpoints: []*endpoint.LocalityLbEndpoints{{
-			LbEndpoints: []*endpoint.LbEndpoint{{
-				HostIdentifier: &endpoint.LbEndpoint_Endpoint{
-					Endpoint: &endpoint.Endpoint{
-						Address: &core.Address{
-							Address: &core.Address_SocketAddress{
-								SocketAddress: &core.SocketAddress{
-									Protocol:      labels.Endpoint.Protocol,
-									Address:       "tasks." + service.Spec.Name,
-									PortSpecifier: &labels.Endpoint.Port,
-								},
-							},
-						},
-					},
-				},
-			}},
-		}},
-	}
-}
-
-func convertServiceToCluster(service *swarm.Service, loadAssignment *endpoint.ClusterLoadAssignment) *cluster.Cluster {
+func convertServiceToCluster(clusterName string, labels *ServiceLabel) (c *cluster.Cluster) {
 	const UpstreamConnectTimeout = 2 * time.Second
-	const DNSRefreshRate = 4 * time.Second // When updating services, swarms default delay is 5 seconds, setting this to 4 leaves us with a 1 drain time (worst case)
 	const PerConnectionBufferLimit = 32768 // 32 KiB
 	const UpstreamTCPKeepaliveProbes = 3
 	const UpstreamTCPKeepaliveTime = 3600
 	const UpstreamTCPKeepaliveInterval = 60
 
-	return &cluster.Cluster{
-		Name:                          service.Spec.Name,
-		ConnectTimeout:                durationpb.New(UpstreamConnectTimeout),
-		ClusterDiscoveryType:          &cluster.Cluster_Type{Type: cluster.Cluster_STRICT_DNS},
-		RespectDnsTtl:                 false, // Default TTL is 600, which is too long in the case of scaling down
-		DnsRefreshRate:                durationpb.New(DNSRefreshRate),
-		LoadAssignment:                loadAssignment,
+	c = &cluster.Cluster{
+		Name:                 clusterName,
+		ConnectTimeout:       durationpb.New(UpstreamConnectTimeout),
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
+		LbPolicy:             lbPolicies[labels.LoadBalancingPolicy()],
+		EdsClusterConfig: &cluster.Cluster_EdsClusterConfig{
+			EdsConfig: &core.ConfigSource{
+				ResourceApiVersion:    core.ApiVersion_V3,
+				ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}},
+			},
+		},
 		PerConnectionBufferLimitBytes: &wrapperspb.UInt32Value{Value: uint32(PerConnectionBufferLimit)},
 		UpstreamConnectionOptions: &cluster.UpstreamConnectionOptions{
 			// Unsure if these values make sense, I lowered the linux defaults as I expect the network to be more reliable than the www
@@ -74,5 +51,100 @@ func convertServiceToCluster(service *swarm.Service, loadAssignment *endpoint.Cl
 				KeepaliveInterval: &wrapperspb.UInt32Value{Value: uint32(UpstreamTCPKeepaliveInterval)},
 			},
 		},
+		CircuitBreakers:  createCircuitBreakers(&labels.Endpoint.CircuitBreaker),
+		OutlierDetection: createOutlierDetection(&labels.Endpoint.Outlier),
+		HealthChecks:     createHealthChecks(&labels.Endpoint.HealthCheck),
+	}
+
+	if labels.Endpoint.HTTP2 {
+		c.TypedExtensionProtocolOptions = createHTTP2ProtocolOptions()
 	}
+
+	return c
+}
+
+// createHTTP2ProtocolOptions makes envoy use HTTP/2 towards the upstream, which gRPC requires
+func createHTTP2ProtocolOptions() map[string]*anypb.Any {
+	protocolOptions, _ := anypb.New(&upstreamhttp.HttpProtocolOptions{
+		UpstreamProtocolOptions: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_{
+			ExplicitHttpConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig{
+				ProtocolConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_Http2ProtocolOptions{
+					Http2ProtocolOptions: &core.Http2ProtocolOptions{},
+				},
+			},
+		},
+	})
+
+	return map[string]*anypb.Any{"envoy.extensions.upstreams.http.v3.HttpProtocolOptions": protocolOptions}
+}
+
+var lbPolicies = map[LbPolicy]cluster.Cluster_LbPolicy{
+	LbPolicyRoundRobin:   cluster.Cluster_ROUND_ROBIN,
+	LbPolicyLeastRequest: cluster.Cluster_LEAST_REQUEST,
+	LbPolicyRandom:       cluster.Cluster_RANDOM,
+	LbPolicyRingHash:     cluster.Cluster_RING_HASH,
+	LbPolicyMaglev:       cluster.Cluster_MAGLEV,
+}
+
+func createHealthChecks(h *ServiceHealthCheck) []*core.HealthCheck {
+	if h.Path == "" {
+		return nil
+	}
+
+	return []*core.HealthCheck{{
+		Interval:           durationpb.New(h.Interval),
+		Timeout:            durationpb.New(h.Timeout),
+		HealthyThreshold:   &wrapperspb.UInt32Value{Value: h.HealthyThreshold},
+		UnhealthyThreshold: &wrapperspb.UInt32Value{Value: h.UnhealthyThreshold},
+		HealthChecker: &core.HealthCheck_HttpHealthCheck_{
+			HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{Path: h.Path},
+		},
+	}}
+}
+
+func createCircuitBreakers(b *ServiceCircuitBreaker) *cluster.CircuitBreakers {
+	if *b == (ServiceCircuitBreaker{}) {
+		return nil
+	}
+
+	return &cluster.CircuitBreakers{
+		Thresholds: []*cluster.CircuitBreakers_Thresholds{{
+			Priority:           core.RoutingPriority_DEFAULT,
+			MaxConnections:     optionalUInt32(b.MaxConnections),
+			MaxPendingRequests: optionalUInt32(b.MaxPendingRequests),
+			MaxRequests:        optionalUInt32(b.MaxRequests),
+			MaxRetries:         optionalUInt32(b.MaxRetries),
+		}},
+	}
+}
+
+func createOutlierDetection(o *ServiceOutlierDetection) *cluster.OutlierDetection {
+	if o.Consecutive5xx == 0 {
+		return nil
+	}
+
+	return &cluster.OutlierDetection{
+		Consecutive_5Xx:    &wrapperspb.UInt32Value{Value: o.Consecutive5xx},
+		Interval:           optionalDuration(o.Interval),
+		BaseEjectionTime:   optionalDuration(o.BaseEjectionTime),
+		MaxEjectionPercent: optionalUInt32(o.MaxEjectionPercent),
+	}
+}
+
+// optionalUInt32 leaves zero values out of the config so envoy will apply its own default
+func optionalUInt32(v uint32) *wrapperspb.UInt32Value {
+	if v == 0 {
+		return nil
+	}
+
+	return &wrapperspb.UInt32Value{Value: v}
+}
+
+// optionalDuration leaves zero values out of the config so envoy will apply its own default
+func optionalDuration(d time.Duration) *durationpb.Duration {
+	if d == 0 {
+		return nil
+	}
+
+	return durationpb.New(d)
 }
@@ -0,0 +1,117 @@
+package converting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	types "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func createService(name string) *swarm.Service {
+	return &swarm.Service{Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: name}}}
+}
+
+func createClusterLabels() *ServiceLabel {
+	labels := NewServiceLabel()
+	labels.Route.Domain = "example.com"
+	labels.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+
+	return &labels
+}
+
+func TestServiceToClusterUsesLabelClusterName(t *testing.T) {
+	labels := createClusterLabels()
+	labels.Index = "1"
+
+	c, err := ServiceToCluster(createService("api"), labels)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "api_1", c.Name)
+}
+
+func TestServiceToClusterDiscoversEndpointsOverADS(t *testing.T) {
+	c, err := ServiceToCluster(createService("api"), createClusterLabels())
+
+	assert.NoError(t, err)
+	assert.Equal(t, "EDS", c.GetType().String())
+	assert.NotNil(t, c.EdsClusterConfig.EdsConfig.GetAds())
+	assert.Nil(t, c.LoadAssignment)
+}
+
+func TestServiceToClusterHasNoCircuitBreakersByDefault(t *testing.T) {
+	c, err := ServiceToCluster(createService("api"), createClusterLabels())
+
+	assert.NoError(t, err)
+	assert.Nil(t, c.CircuitBreakers)
+	assert.Nil(t, c.OutlierDetection)
+}
+
+func TestServiceToClusterCircuitBreakers(t *testing.T) {
+	labels := createClusterLabels()
+	labels.Endpoint.CircuitBreaker.MaxConnections = 100
+	labels.Endpoint.CircuitBreaker.MaxPendingRequests = 10
+
+	c, err := ServiceToCluster(createService("api"), labels)
+
+	assert.NoError(t, err)
+	thresholds := c.CircuitBreakers.Thresholds[0]
+	assert.Equal(t, uint32(100), thresholds.MaxConnections.Value)
+	assert.Equal(t, uint32(10), thresholds.MaxPendingRequests.Value)
+	assert.Nil(t, thresholds.MaxRequests)
+	assert.Nil(t, thresholds.MaxRetries)
+}
+
+func TestServiceToClusterOutlierDetection(t *testing.T) {
+	labels := createClusterLabels()
+	labels.Endpoint.Outlier.Consecutive5xx = 5
+	labels.Endpoint.Outlier.BaseEjectionTime = time.Minute
+
+	c, err := ServiceToCluster(createService("api"), labels)
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(5), c.OutlierDetection.Consecutive_5Xx.Value)
+	assert.Equal(t, time.Minute, c.OutlierDetection.BaseEjectionTime.AsDuration())
+	assert.Nil(t, c.OutlierDetection.Interval)
+}
+
+func TestServiceToClusterHasNoHealthChecksByDefault(t *testing.T) {
+	c, err := ServiceToCluster(createService("api"), createClusterLabels())
+
+	assert.NoError(t, err)
+	assert.Empty(t, c.HealthChecks)
+}
+
+func TestServiceToClusterHealthCheck(t *testing.T) {
+	labels := createClusterLabels()
+	labels.Endpoint.HealthCheck.Path = "/ready"
+
+	c, err := ServiceToCluster(createService("api"), labels)
+
+	assert.NoError(t, err)
+	assert.Len(t, c.HealthChecks, 1)
+	assert.Equal(t, "/ready", c.HealthChecks[0].GetHttpHealthCheck().Path)
+	assert.Equal(t, 10*time.Second, c.HealthChecks[0].Interval.AsDuration())
+	assert.Equal(t, uint32(3), c.HealthChecks[0].UnhealthyThreshold.Value)
+}
+
+func TestServiceToClusterLbPolicy(t *testing.T) {
+	labels := createClusterLabels()
+	labels.Endpoint.LbPolicy = LbPolicyLeastRequest
+
+	c, err := ServiceToCluster(createService("api"), labels)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "LEAST_REQUEST", c.LbPolicy.String())
+}
+
+func TestServiceToClusterHTTP2(t *testing.T) {
+	labels := createClusterLabels()
+	labels.Endpoint.HTTP2 = true
+
+	c, err := ServiceToCluster(createService("sso-gateway"), labels)
+
+	assert.NoError(t, err)
+	assert.Contains(t, c.TypedExtensionProtocolOptions, "envoy.extensions.upstreams.http.v3.HttpProtocolOptions")
+}
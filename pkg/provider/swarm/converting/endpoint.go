@@ -0,0 +1,74 @@
+package converting
+
+import (
+	"net"
+	"sort"
+
+	"github.com/docker/docker/api/types/swarm"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+)
+
+// TasksToLoadAssignment will convert the running tasks of a service into the endpoints of a cluster
+// Tasks are reached by their IP address on the ingress network, tasks without such an address are left out
+func TasksToLoadAssignment(clusterName string, tasks []swarm.Task, ingressNetworkID string, labels *ServiceLabel) (e *endpoint.ClusterLoadAssignment, err error) {
+	var addresses []string
+	for i := range tasks {
+		if address := taskAddress(&tasks[i], ingressNetworkID); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+
+	// The task list has no guaranteed order, sorting prevents needless endpoint updates
+	sort.Strings(addresses)
+
+	lbEndpoints := make([]*endpoint.LbEndpoint, 0, len(addresses))
+	for _, address := range addresses {
+		lbEndpoints = append(lbEndpoints, createLbEndpoint(address, labels))
+	}
+
+	e = &endpoint.ClusterLoadAssignment{
+		ClusterName: clusterName,
+		Endpoints:   []*endpoint.LocalityLbEndpoints{{LbEndpoints: lbEndpoints}},
+	}
+	if err = e.Validate(); err != nil {
+		return
+	}
+
+	return
+}
+
+func createLbEndpoint(address string, labels *ServiceLabel) *endpoint.LbEndpoint {
+	return &endpoint.LbEndpoint{
+		HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+			Endpoint: &endpoint.Endpoint{
+				Address: &core.Address{
+					Address: &core.Address_SocketAddress{
+						SocketAddress: &core.SocketAddress{
+							Protocol:      labels.Endpoint.Protocol,
+							Address:       address,
+							PortSpecifier: &core.SocketAddress_PortValue{PortValue: labels.Endpoint.Port.PortValue},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// taskAddress returns the IP address of a task within the given network, the attachment lists them in CIDR notation
+func taskAddress(task *swarm.Task, networkID string) string {
+	for _, attachment := range task.NetworksAttachments {
+		if attachment.Network.ID != networkID {
+			continue
+		}
+
+		for _, address := range attachment.Addresses {
+			if ip, _, err := net.ParseCIDR(address); err == nil {
+				return ip.String()
+			}
+		}
+	}
+
+	return ""
+}
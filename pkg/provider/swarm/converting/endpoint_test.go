@@ -0,0 +1,42 @@
+package converting
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/stretchr/testify/assert"
+)
+
+func createTask(attachments ...swarm.NetworkAttachment) swarm.Task {
+	return swarm.Task{NetworksAttachments: attachments}
+}
+
+func createAttachment(networkID, address string) swarm.NetworkAttachment {
+	return swarm.NetworkAttachment{Network: swarm.Network{ID: networkID}, Addresses: []string{address}}
+}
+
+func TestTasksToLoadAssignmentUsesIngressAddresses(t *testing.T) {
+	tasks := []swarm.Task{
+		createTask(createAttachment("other", "10.0.9.4/24"), createAttachment("ingress", "10.0.1.7/24")),
+		createTask(createAttachment("ingress", "10.0.1.3/24")),
+	}
+
+	e, err := TasksToLoadAssignment("api", tasks, "ingress", createClusterLabels())
+
+	assert.NoError(t, err)
+	assert.Equal(t, "api", e.ClusterName)
+	lbEndpoints := e.Endpoints[0].LbEndpoints
+	assert.Len(t, lbEndpoints, 2)
+	assert.Equal(t, "10.0.1.3", lbEndpoints[0].GetEndpoint().Address.GetSocketAddress().Address)
+	assert.Equal(t, "10.0.1.7", lbEndpoints[1].GetEndpoint().Address.GetSocketAddress().Address)
+	assert.Equal(t, uint32(80), lbEndpoints[1].GetEndpoint().Address.GetSocketAddress().GetPortValue())
+}
+
+func TestTasksToLoadAssignmentSkipsTasksOutsideIngress(t *testing.T) {
+	tasks := []swarm.Task{createTask(createAttachment("other", "10.0.9.4/24")), createTask()}
+
+	e, err := TasksToLoadAssignment("api", tasks, "ingress", createClusterLabels())
+
+	assert.NoError(t, err)
+	assert.Empty(t, e.Endpoints[0].LbEndpoints)
+}
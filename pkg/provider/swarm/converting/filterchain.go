@@ -11,18 +11,45 @@ import (
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	ratelimitconfig "github.com/envoyproxy/go-control-plane/envoy/config/ratelimit/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	basicauth "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/basic_auth/v3"
+	cors "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
+	extauthz "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	jwtauthn "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	localratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ratelimit/v3"
+	rbac "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
 	router "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
 	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tcpproxy "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
 	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
 )
 
+// Names of HTTP filters that are configured per route
+const (
+	LocalRateLimitFilterName = "envoy.filters.http.local_ratelimit"
+	RBACFilterName           = "envoy.filters.http.rbac"
+	BasicAuthFilterName      = "envoy.filters.http.basic_auth"
+	JWTAuthnFilterName       = "envoy.filters.http.jwt_authn"
+)
+
+// ACMETLSALPNProtocol is negotiated by ACME servers that validate a TLS-ALPN-01 challenge, @see RFC 8737
+const ACMETLSALPNProtocol = "acme-tls/1"
+
 type FilterChainBuilder struct {
 	name                 string
 	configureTLS         bool
 	sniServerNames       []string
 	sdsCertificateConfig *auth.SdsSecretConfig
+	rateLimitDomain      string
+	rateLimitCluster     string
+	trustedProxyHops     uint32
+	authorizations       []ServiceExtAuthz
+	jwtProviders         map[string]ServiceJWT
+	challengeCluster     string
 	vhosts               []*route.VirtualHost
 }
 
@@ -42,6 +69,45 @@ func (b *FilterChainBuilder) EnableTLS(serverNames []string, sdsConfig *auth.Sds
 	return b
 }
 
+// ForTLSALPNChallenges proxies TLS connections that negotiate the ACME protocol to the cluster of the control plane,
+// which presents the challenge certificate itself. Regular HTTPS traffic for the server names is left untouched
+func (b *FilterChainBuilder) ForTLSALPNChallenges(serverNames []string, clusterName string) *FilterChainBuilder {
+	b.sniServerNames = serverNames
+	b.challengeCluster = clusterName
+
+	return b
+}
+
+// WithRateLimitService adds the global ratelimit filter, only routes with descriptors will call the ratelimit service
+func (b *FilterChainBuilder) WithRateLimitService(domain, clusterName string) *FilterChainBuilder {
+	b.rateLimitDomain = domain
+	b.rateLimitCluster = clusterName
+
+	return b
+}
+
+// WithTrustedProxyHops sets the amount of X-Forwarded-For entries added by proxies in front of envoy, like a load balancer
+// The client address used for logging and route.allow-cidrs is taken from the X-Forwarded-For header at that position
+func (b *FilterChainBuilder) WithTrustedProxyHops(hops uint32) *FilterChainBuilder {
+	b.trustedProxyHops = hops
+
+	return b
+}
+
+// WithExternalAuthorizations adds a disabled ext_authz filter per authorization service, routes enable the one they use
+func (b *FilterChainBuilder) WithExternalAuthorizations(authorizations []ServiceExtAuthz) *FilterChainBuilder {
+	b.authorizations = authorizations
+
+	return b
+}
+
+// WithJWTProviders adds the jwt_authn filter, routes refer to the requirement of their provider
+func (b *FilterChainBuilder) WithJWTProviders(providers map[string]ServiceJWT) *FilterChainBuilder {
+	b.jwtProviders = providers
+
+	return b
+}
+
 func (b *FilterChainBuilder) ForVhost(vhost *route.VirtualHost) *FilterChainBuilder {
 	b.vhosts = append(b.vhosts, vhost)
 
@@ -49,6 +115,10 @@ func (b *FilterChainBuilder) ForVhost(vhost *route.VirtualHost) *FilterChainBuil
 }
 
 func (b *FilterChainBuilder) Build() *listener.FilterChain {
+	if b.challengeCluster != "" {
+		return b.buildTLSALPNChallengeFilterChain()
+	}
+
 	filterChain := listener.FilterChain{Name: b.name}
 	if len(b.vhosts) > 0 {
 		filterChain.Filters = append(filterChain.Filters, b.buildHTTPFilterForVhosts())
@@ -77,21 +147,18 @@ func (b *FilterChainBuilder) buildHTTPFilterForVhosts() *listener.Filter {
 		routeType = "https"
 	}
 
-	routerConfig, _ := anypb.New(&router.Router{})
 	routes := &route.RouteConfiguration{
 		Name:         fmt.Sprintf("%s_%s_routes", b.name, routeType),
 		VirtualHosts: b.vhosts,
 	}
 	conManager := &hcm.HttpConnectionManager{
-		ServerName:       ServerName,
-		CodecType:        hcm.HttpConnectionManager_AUTO,
-		StatPrefix:       b.name,
-		UseRemoteAddress: &wrapperspb.BoolValue{Value: true},
-		RouteSpecifier:   &hcm.HttpConnectionManager_RouteConfig{RouteConfig: routes},
-		HttpFilters: []*hcm.HttpFilter{{
-			Name:       wellknown.Router,
-			ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: routerConfig},
-		}},
+		ServerName:        ServerName,
+		CodecType:         hcm.HttpConnectionManager_AUTO,
+		StatPrefix:        b.name,
+		UseRemoteAddress:  &wrapperspb.BoolValue{Value: true},
+		XffNumTrustedHops: b.trustedProxyHops,
+		RouteSpecifier:    &hcm.HttpConnectionManager_RouteConfig{RouteConfig: routes},
+		HttpFilters:       b.buildHTTPFilters(),
 		Http2ProtocolOptions: &core.Http2ProtocolOptions{
 			MaxConcurrentStreams:        &wrapperspb.UInt32Value{Value: uint32(MaxConcurrentHTTP2Streams)},
 			InitialStreamWindowSize:     &wrapperspb.UInt32Value{Value: uint32(InitialDownstreamHTTP2StreamWindowSize)},
@@ -113,6 +180,178 @@ func (b *FilterChainBuilder) buildHTTPFilterForVhosts() *listener.Filter {
 	}
 }
 
+// buildHTTPFilters creates the filters shared by all vhosts, filters that depend on labels are enabled per route
+func (b *FilterChainBuilder) buildHTTPFilters() []*hcm.HttpFilter {
+	// Without a token bucket the local rate limiter is idle until a route configures one
+	localRateLimitConfig, _ := anypb.New(&localratelimit.LocalRateLimit{StatPrefix: "http_local_rate_limiter"})
+	// Without rules, the RBAC filter only enforces the policies of routes
+	rbacConfig, _ := anypb.New(&rbac.RBAC{})
+	basicAuthConfig, _ := anypb.New(&basicauth.BasicAuth{})
+	corsConfig, _ := anypb.New(&cors.Cors{})
+	routerConfig, _ := anypb.New(&router.Router{})
+
+	// RBAC and CORS come first, so preflight requests are answered without authentication or rate limiting
+	filters := []*hcm.HttpFilter{
+		{
+			Name:       RBACFilterName,
+			ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: rbacConfig},
+		},
+		{
+			Name:       wellknown.CORS,
+			ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: corsConfig},
+		},
+		{
+			// Routes can only enable basic auth when the filter is disabled by default
+			Name:       BasicAuthFilterName,
+			ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: basicAuthConfig},
+			Disabled:   true,
+		},
+	}
+
+	if len(b.jwtProviders) > 0 {
+		filters = append(filters, b.buildJWTAuthnFilter())
+	}
+
+	for _, authorization := range b.authorizations {
+		filters = append(filters, buildExtAuthzFilter(authorization))
+	}
+
+	filters = append(filters, &hcm.HttpFilter{
+		Name:       LocalRateLimitFilterName,
+		ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: localRateLimitConfig},
+	})
+
+	if b.rateLimitCluster != "" {
+		filters = append(filters, b.buildRateLimitFilter())
+	}
+
+	return append(filters, &hcm.HttpFilter{
+		Name:       wellknown.Router,
+		ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: routerConfig},
+	})
+}
+
+func (b *FilterChainBuilder) buildJWTAuthnFilter() *hcm.HttpFilter {
+	const JwksFetchTimeout = 5 * time.Second
+	const JwksCacheDuration = 10 * time.Minute
+
+	config := &jwtauthn.JwtAuthentication{
+		Providers:      make(map[string]*jwtauthn.JwtProvider, len(b.jwtProviders)),
+		RequirementMap: make(map[string]*jwtauthn.JwtRequirement, len(b.jwtProviders)),
+	}
+
+	for name, j := range b.jwtProviders {
+		config.Providers[name] = &jwtauthn.JwtProvider{
+			Issuer:    j.Issuer,
+			Audiences: j.Audiences,
+			JwksSourceSpecifier: &jwtauthn.JwtProvider_RemoteJwks{RemoteJwks: &jwtauthn.RemoteJwks{
+				HttpUri: &core.HttpUri{
+					Uri:              j.JwksURI,
+					HttpUpstreamType: &core.HttpUri_Cluster{Cluster: JWKSClusterName(j.JwksURI)},
+					Timeout:          durationpb.New(JwksFetchTimeout),
+				},
+				CacheDuration: durationpb.New(JwksCacheDuration),
+				AsyncFetch:    &jwtauthn.JwksAsyncFetch{},
+			}},
+			// Services that still validate tokens themselves keep receiving the Authorization header
+			Forward:              true,
+			ForwardPayloadHeader: j.ForwardPayloadHeader,
+		}
+		config.RequirementMap[name] = &jwtauthn.JwtRequirement{
+			RequiresType: &jwtauthn.JwtRequirement_ProviderName{ProviderName: name},
+		}
+	}
+
+	typedConfig, _ := anypb.New(config)
+
+	return &hcm.HttpFilter{
+		Name:       JWTAuthnFilterName,
+		ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: typedConfig},
+	}
+}
+
+// ExtAuthzFilterName identifies the ext_authz filter instance of an authorization service
+func ExtAuthzFilterName(a ServiceExtAuthz) string {
+	return fmt.Sprintf("%s.%s.%s", wellknown.HTTPExternalAuthorization, a.Mode, a.Cluster)
+}
+
+func buildExtAuthzFilter(a ServiceExtAuthz) *hcm.HttpFilter {
+	const AuthorizationTimeout = 2 * time.Second
+	config := &extauthz.ExtAuthz{TransportApiVersion: core.ApiVersion_V3}
+
+	if a.Mode == ExtAuthzModeGRPC {
+		config.Services = &extauthz.ExtAuthz_GrpcService{GrpcService: &core.GrpcService{
+			TargetSpecifier: &core.GrpcService_EnvoyGrpc_{EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: a.Cluster}},
+			Timeout:         durationpb.New(AuthorizationTimeout),
+		}}
+	} else {
+		config.Services = &extauthz.ExtAuthz_HttpService{HttpService: &extauthz.HttpService{
+			ServerUri: &core.HttpUri{
+				Uri:              "http://" + a.Cluster,
+				HttpUpstreamType: &core.HttpUri_Cluster{Cluster: a.Cluster},
+				Timeout:          durationpb.New(AuthorizationTimeout),
+			},
+		}}
+
+		// Besides the defaults like Authorization, login sessions of an SSO gateway are usually kept in cookies
+		config.AllowedHeaders = &matcher.ListStringMatcher{Patterns: []*matcher.StringMatcher{
+			{MatchPattern: &matcher.StringMatcher_Exact{Exact: "cookie"}},
+			{MatchPattern: &matcher.StringMatcher_Prefix{Prefix: "x-forwarded-"}},
+		}}
+	}
+
+	typedConfig, _ := anypb.New(config)
+
+	return &hcm.HttpFilter{
+		Name:       ExtAuthzFilterName(a),
+		ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: typedConfig},
+		Disabled:   true,
+	}
+}
+
+func (b *FilterChainBuilder) buildRateLimitFilter() *hcm.HttpFilter {
+	const RateLimitServiceTimeout = 100 * time.Millisecond
+
+	// When the ratelimit service is unavailable requests are allowed, an outage should not take down every service
+	rateLimitConfig, _ := anypb.New(&ratelimit.RateLimit{
+		Domain:          b.rateLimitDomain,
+		Timeout:         durationpb.New(RateLimitServiceTimeout),
+		FailureModeDeny: false,
+		RateLimitService: &ratelimitconfig.RateLimitServiceConfig{
+			TransportApiVersion: core.ApiVersion_V3,
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: b.rateLimitCluster},
+				},
+			},
+		},
+	})
+
+	return &hcm.HttpFilter{
+		Name:       wellknown.HTTPRateLimit,
+		ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: rateLimitConfig},
+	}
+}
+
+func (b *FilterChainBuilder) buildTLSALPNChallengeFilterChain() *listener.FilterChain {
+	proxyConfig, _ := anypb.New(&tcpproxy.TcpProxy{
+		StatPrefix:       b.name,
+		ClusterSpecifier: &tcpproxy.TcpProxy_Cluster{Cluster: b.challengeCluster},
+	})
+
+	return &listener.FilterChain{
+		Name: b.name,
+		FilterChainMatch: &listener.FilterChainMatch{
+			ServerNames:          b.sniServerNames,
+			ApplicationProtocols: []string{ACMETLSALPNProtocol},
+		},
+		Filters: []*listener.Filter{{
+			Name:       wellknown.TCPProxy,
+			ConfigType: &listener.Filter_TypedConfig{TypedConfig: proxyConfig},
+		}},
+	}
+}
+
 func (b *FilterChainBuilder) buildDownstreamTransportSocket() *core.TransportSocket {
 	c := &auth.DownstreamTlsContext{
 		CommonTlsContext: &auth.CommonTlsContext{
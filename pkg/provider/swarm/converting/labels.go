@@ -3,7 +3,10 @@ package converting
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,17 +19,270 @@ type ServiceEndpoint struct {
 	RequestTimeout time.Duration
 	Protocol       types.SocketAddress_Protocol
 	Port           types.SocketAddress_PortValue
+	CircuitBreaker ServiceCircuitBreaker
+	Outlier        ServiceOutlierDetection
+	HealthCheck    ServiceHealthCheck
+	LbPolicy       LbPolicy // empty picks ring-hash when the route hashes requests, round-robin otherwise
+	HTTP2          bool     // required for gRPC services
+}
+
+// LbPolicy is the algorithm envoy uses to pick an upstream within a cluster
+type LbPolicy string
+
+const (
+	LbPolicyRoundRobin   LbPolicy = "round-robin"
+	LbPolicyLeastRequest LbPolicy = "least-request"
+	LbPolicyRandom       LbPolicy = "random"
+	LbPolicyRingHash     LbPolicy = "ring-hash"
+	LbPolicyMaglev       LbPolicy = "maglev"
+)
+
+// ServiceHealthCheck lets envoy actively check each upstream over HTTP, an empty path disables health checking
+type ServiceHealthCheck struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   uint32
+	UnhealthyThreshold uint32
+}
+
+// ServiceCircuitBreaker limits what envoy sends to a cluster, zero values keep the envoy default of 1024 (3 retries)
+type ServiceCircuitBreaker struct {
+	MaxConnections     uint32
+	MaxPendingRequests uint32
+	MaxRequests        uint32
+	MaxRetries         uint32
+}
+
+// ServiceOutlierDetection ejects upstreams that keep failing, zero values keep the envoy defaults
+type ServiceOutlierDetection struct {
+	Consecutive5xx     uint32 // outlier detection is disabled when 0
+	Interval           time.Duration
+	BaseEjectionTime   time.Duration
+	MaxEjectionPercent uint32
+}
+
+// PathMatch describes how the route.path label is matched against the request path
+type PathMatch string
+
+const (
+	PathMatchPrefix              PathMatch = "prefix"
+	PathMatchExact               PathMatch = "exact"
+	PathMatchRegex               PathMatch = "regex"
+	PathMatchPathSeparatedPrefix PathMatch = "path-separated-prefix" // like prefix, but /api won't match /apiary
+)
+
+// ValueMatch describes how a header or query parameter value is matched
+type ValueMatch string
+
+const (
+	ValueMatchExact   ValueMatch = "exact"
+	ValueMatchPrefix  ValueMatch = "prefix"
+	ValueMatchRegex   ValueMatch = "regex"
+	ValueMatchPresent ValueMatch = "present"
+)
+
+// RequestMatcher is a header or query parameter that should be present in the request to match the route
+type RequestMatcher struct {
+	Name  string
+	Match ValueMatch
+	Value string
 }
 
 type ServiceRoute struct {
-	Domain       string
-	ExtraDomains []string // Note that you cannot assume that the domain or extraDomains are valid and reachable
-	PathPrefix   string
+	Domain          string
+	ExtraDomains    []string // Note that you cannot assume that the domain or extraDomains are valid and reachable
+	Path            string
+	PathMatch       PathMatch
+	Headers         []RequestMatcher
+	QueryParameters []RequestMatcher
+	Rewrite         ServiceRewrite
+	Weight          uint32 // only used when multiple services share the same domain and path
+	Mirror          ServiceMirror
+	Retry           ServiceRetry
+	Affinity        ServiceAffinity
+	RateLimit       ServiceRateLimit
+	Cors            ServiceCors
+	AllowCIDRs      []string // when set, only these client addresses can reach the route
+	DenyCIDRs       []string
+	BasicAuth       ServiceBasicAuth
+	ExtAuthz        ServiceExtAuthz
+	JWT             ServiceJWT
+	HeaderMutation  ServiceHeaderMutation
+	HTTPS           ServiceHTTPS
+}
+
+// ServiceHTTPS describes how the route behaves once its vhost has a certificate
+type ServiceHTTPS struct {
+	Redirect     bool   // when false, the route is served over both HTTP and HTTPS
+	RedirectCode uint32 // 301 or 308
+	HSTS         string // the Strict-Transport-Security value, like max-age=31536000;includeSubDomains
+}
+
+// ServiceHeaderMutation adds or removes headers of requests and responses, added values can use envoy's
+// command operators like %HOSTNAME% or %DOWNSTREAM_REMOTE_ADDRESS%
+type ServiceHeaderMutation struct {
+	RequestAdd     map[string]string
+	RequestRemove  []string
+	ResponseAdd    map[string]string
+	ResponseRemove []string
+}
+
+// ServiceJWT requires a valid bearer token for the route, requests without one receive a 401 response
+type ServiceJWT struct {
+	Issuer               string
+	Audiences            []string
+	JwksURI              string // keys are fetched through a cluster for the host of this URI
+	ForwardPayloadHeader string
+}
+
+func (j ServiceJWT) enabled() bool {
+	return j.Issuer != "" || j.JwksURI != ""
+}
+
+// ExtAuthzMode is the protocol envoy uses to ask the authorization service if a request is allowed
+type ExtAuthzMode string
+
+const (
+	ExtAuthzModeHTTP ExtAuthzMode = "http"
+	ExtAuthzModeGRPC ExtAuthzMode = "grpc" // routes are rejected when the authorization service lacks the endpoint.http2 label
+)
+
+// ServiceExtAuthz lets another swarm service authorize each request before it is sent upstream
+type ServiceExtAuthz struct {
+	Cluster string
+	Mode    ExtAuthzMode
+}
+
+// ServiceBasicAuth protects the route with a password, the users are loaded from a swarm config in htpasswd format
+type ServiceBasicAuth struct {
+	Config string
+	Users  string // set by the provider after loading the config
+}
+
+// SetUsers validates the htpasswd contents, envoy only supports SHA hashed passwords (htpasswd -s)
+func (a *ServiceBasicAuth) SetUsers(htpasswd []byte) error {
+	users := 0
+	for _, line := range strings.Split(string(htpasswd), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		user, hash, _ := strings.Cut(line, ":")
+		if user == "" || !strings.HasPrefix(hash, "{SHA}") {
+			return fmt.Errorf("the route.basic-auth-config %s should only contain users with SHA hashed passwords", a.Config)
+		}
+		users++
+	}
+
+	if users == 0 {
+		return fmt.Errorf("the route.basic-auth-config %s contains no users", a.Config)
+	}
+
+	a.Users = string(htpasswd)
+
+	return nil
+}
+
+// ServiceCors lets browsers call the service from other origins, CORS is disabled when there are no allowed origins
+type ServiceCors struct {
+	AllowOrigins     []string // exact origins, * or matchers like prefix:https:// and regex:^https://.*\.example\.com$
+	AllowMethods     []string
+	AllowHeaders     []string
+	ExposeHeaders    []string
+	MaxAge           time.Duration
+	AllowCredentials bool
+}
+
+func (c ServiceCors) enabled() bool {
+	return len(c.AllowOrigins) > 0
+}
+
+// ServiceRateLimit is a token bucket per envoy instance, requests above the limit receive a 429 response
+// Descriptors are sent to the global ratelimit service instead, so limits are shared across all envoy instances
+type ServiceRateLimit struct {
+	Requests    uint32 // local rate limiting is disabled when 0
+	Unit        time.Duration
+	Burst       uint32 // defaults to the amount of requests per unit
+	Descriptors []RateLimitDescriptor
+}
+
+// RateLimitDescriptor is a list of entries that the ratelimit service matches against its configured limits
+type RateLimitDescriptor []RateLimitEntry
+
+// RateLimitEntry is a single descriptor entry, like remote_address or header:x-api-key=api_key
+type RateLimitEntry struct {
+	Type  string // remote_address, destination_cluster, generic_key or header
+	Name  string // the header name
+	Value string // the generic_key value or the descriptor key of a header
+}
+
+// MaxTokens is the size of the token bucket, allowing bursts above the requests per unit
+func (r ServiceRateLimit) MaxTokens() uint32 {
+	if r.Burst == 0 {
+		return r.Requests
+	}
+
+	return r.Burst
+}
+
+// ServiceAffinity hashes requests so they stick to the same upstream, this requires a ring-hash or maglev lb-policy
+type ServiceAffinity struct {
+	Cookie    string        // envoy generates the cookie when the request doesn't have one
+	CookieTTL time.Duration // 0 results in a session cookie
+	Header    string
+}
+
+func (a ServiceAffinity) enabled() bool {
+	return a.Cookie != "" || a.Header != ""
+}
+
+// ServiceRetry configures when envoy should retry a request at another upstream, 0 retries disables the policy
+type ServiceRetry struct {
+	On                   []string
+	Retries              uint32
+	PerTryTimeout        time.Duration
+	RetriableStatusCodes []uint32
+}
+
+// ServiceMirror sends a copy of the traffic to another cluster, responses of the mirror are ignored
+type ServiceMirror struct {
+	Cluster string
+	Percent float64
+}
+
+// ServiceRewrite changes the request before it is sent upstream, handy when a service expects to be mounted at /
+type ServiceRewrite struct {
+	Prefix            string
+	RegexPattern      string
+	RegexSubstitution string
+	Host              string
 }
 
 type ServiceLabel struct {
+	Index    string // empty for unindexed labels, otherwise the n in envoy.n.endpoint.port
 	Endpoint ServiceEndpoint
 	Route    ServiceRoute
+	TLS      ServiceTLS
+}
+
+// Certificate issuers with a special meaning, any other issuer refers to a named ACME configuration
+const (
+	TLSIssuerACME   = "acme"   // the default ACME configuration
+	TLSIssuerNone   = "none"   // the vhost is only served over HTTP
+	TLSIssuerManual = "manual" // the vhost only uses certificates that are already in storage
+)
+
+// ServiceTLS describes where the certificate of the vhost comes from
+type ServiceTLS struct {
+	Issuer string
+}
+
+func (l *ServiceLabel) setTLSProp(property, value string) {
+	switch strings.ToLower(property) {
+	case "issuer":
+		l.TLS.Issuer = strings.ToLower(strings.TrimSpace(value))
+	}
 }
 
 func (l *ServiceLabel) setEndpointProp(property, value string) {
@@ -47,13 +303,171 @@ func (l *ServiceLabel) setEndpointProp(property, value string) {
 		l.Endpoint.Port = types.SocketAddress_PortValue{
 			PortValue: uint32(v),
 		}
+	case "max-connections":
+		setUint32(&l.Endpoint.CircuitBreaker.MaxConnections, value)
+	case "max-pending-requests":
+		setUint32(&l.Endpoint.CircuitBreaker.MaxPendingRequests, value)
+	case "max-requests":
+		setUint32(&l.Endpoint.CircuitBreaker.MaxRequests, value)
+	case "max-retries":
+		setUint32(&l.Endpoint.CircuitBreaker.MaxRetries, value)
+	case "outlier.consecutive-5xx":
+		setUint32(&l.Endpoint.Outlier.Consecutive5xx, value)
+	case "outlier.interval":
+		setDuration(&l.Endpoint.Outlier.Interval, value)
+	case "outlier.base-ejection-time":
+		setDuration(&l.Endpoint.Outlier.BaseEjectionTime, value)
+	case "outlier.max-ejection-percent":
+		setUint32(&l.Endpoint.Outlier.MaxEjectionPercent, value)
+	case "healthcheck.path":
+		l.Endpoint.HealthCheck.Path = fmt.Sprintf("/%s", strings.TrimPrefix(value, "/"))
+	case "healthcheck.interval":
+		setDuration(&l.Endpoint.HealthCheck.Interval, value)
+	case "healthcheck.timeout":
+		setDuration(&l.Endpoint.HealthCheck.Timeout, value)
+	case "healthcheck.healthy-threshold":
+		setUint32(&l.Endpoint.HealthCheck.HealthyThreshold, value)
+	case "healthcheck.unhealthy-threshold":
+		setUint32(&l.Endpoint.HealthCheck.UnhealthyThreshold, value)
+	case "lb-policy":
+		l.Endpoint.LbPolicy = LbPolicy(strings.ToLower(value))
+	case "http2":
+		l.Endpoint.HTTP2, _ = strconv.ParseBool(value)
+	}
+}
+
+// setUint32 only overrides the target when the label value is a valid number
+func setUint32(target *uint32, value string) {
+	if v, err := strconv.ParseUint(value, 10, 32); err == nil {
+		*target = uint32(v)
+	}
+}
+
+// setDuration only overrides the target when the label value is a valid duration like 5s
+func setDuration(target *time.Duration, value string) {
+	if v, err := time.ParseDuration(value); err == nil {
+		*target = v
 	}
 }
 
 func (l *ServiceLabel) setRouteProp(property, value string) {
+	// Header and query parameter names are part of the property, e.g. envoy.route.headers.x-tenant
+	if name, found := cutPrefixFold(property, "headers."); found {
+		l.Route.Headers = setRequestMatcher(l.Route.Headers, parseRequestMatcher(name, value), strings.EqualFold)
+		return
+	}
+
+	if name, found := cutPrefixFold(property, "query."); found {
+		l.Route.QueryParameters = setRequestMatcher(l.Route.QueryParameters, parseRequestMatcher(name, value), func(a, b string) bool { return a == b })
+		return
+	}
+
+	if name, found := cutPrefixFold(property, "request-headers.add."); found {
+		l.Route.HeaderMutation.RequestAdd = setHeader(l.Route.HeaderMutation.RequestAdd, name, value)
+		return
+	}
+
+	if name, found := cutPrefixFold(property, "response-headers.add."); found {
+		l.Route.HeaderMutation.ResponseAdd = setHeader(l.Route.HeaderMutation.ResponseAdd, name, value)
+		return
+	}
+
 	switch strings.ToLower(property) {
 	case "path":
-		l.Route.PathPrefix = fmt.Sprintf("/%s", strings.TrimPrefix(value, "/"))
+		// normalized once all labels are set, as a regex path shouldn't get a leading slash
+		l.Route.Path = value
+	case "match":
+		l.Route.PathMatch = PathMatch(strings.ToLower(value))
+	case "prefix-rewrite":
+		l.Route.Rewrite.Prefix = value
+	case "regex-rewrite":
+		// The pattern can't contain spaces, this allows for a single label like "^/billing/(.*)$ /\1"
+		pattern, substitution, _ := strings.Cut(strings.TrimSpace(value), " ")
+		l.Route.Rewrite.RegexPattern = pattern
+		l.Route.Rewrite.RegexSubstitution = strings.TrimSpace(substitution)
+	case "host-rewrite":
+		l.Route.Rewrite.Host = value
+	case "weight":
+		setUint32(&l.Route.Weight, value)
+	case "mirror-to":
+		l.Route.Mirror.Cluster = value
+	case "retry-on":
+		l.Route.Retry.On = splitList(value)
+	case "retries":
+		setUint32(&l.Route.Retry.Retries, value)
+	case "per-try-timeout":
+		setDuration(&l.Route.Retry.PerTryTimeout, value)
+	case "retriable-status-codes":
+		l.Route.Retry.RetriableStatusCodes = []uint32{}
+		for _, code := range splitList(value) {
+			v, _ := strconv.ParseUint(code, 10, 32)
+			l.Route.Retry.RetriableStatusCodes = append(l.Route.Retry.RetriableStatusCodes, uint32(v))
+		}
+	case "mirror-percent":
+		if percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64); err == nil {
+			l.Route.Mirror.Percent = percent
+		}
+	case "sticky-cookie":
+		l.Route.Affinity.Cookie = value
+	case "sticky-cookie-ttl":
+		setDuration(&l.Route.Affinity.CookieTTL, value)
+	case "hash-header":
+		l.Route.Affinity.Header = value
+	case "ratelimit.requests-per-unit":
+		setUint32(&l.Route.RateLimit.Requests, value)
+	case "ratelimit.unit":
+		l.Route.RateLimit.Unit = parseRateLimitUnit(value)
+	case "ratelimit.burst":
+		setUint32(&l.Route.RateLimit.Burst, value)
+	case "ratelimit.descriptors":
+		l.Route.RateLimit.Descriptors = parseRateLimitDescriptors(value)
+	case "cors.allow-origins":
+		l.Route.Cors.AllowOrigins = splitList(value)
+	case "cors.allow-methods":
+		l.Route.Cors.AllowMethods = splitList(strings.ToUpper(value))
+	case "cors.allow-headers":
+		l.Route.Cors.AllowHeaders = splitList(value)
+	case "cors.expose-headers":
+		l.Route.Cors.ExposeHeaders = splitList(value)
+	case "cors.max-age":
+		// Browsers expect seconds, but a duration like 1h is accepted as well
+		if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+			l.Route.Cors.MaxAge = time.Duration(seconds) * time.Second
+		} else {
+			setDuration(&l.Route.Cors.MaxAge, value)
+		}
+	case "cors.allow-credentials":
+		l.Route.Cors.AllowCredentials, _ = strconv.ParseBool(value)
+	case "allow-cidrs":
+		l.Route.AllowCIDRs = splitList(value)
+	case "deny-cidrs":
+		l.Route.DenyCIDRs = splitList(value)
+	case "basic-auth-config":
+		l.Route.BasicAuth.Config = value
+	case "ext-authz":
+		l.Route.ExtAuthz.Cluster = value
+	case "ext-authz-mode":
+		l.Route.ExtAuthz.Mode = ExtAuthzMode(strings.ToLower(value))
+	case "jwt.issuer":
+		l.Route.JWT.Issuer = value
+	case "jwt.audiences":
+		l.Route.JWT.Audiences = splitList(value)
+	case "jwt.jwks-uri":
+		l.Route.JWT.JwksURI = value
+	case "jwt.forward-payload-header":
+		l.Route.JWT.ForwardPayloadHeader = value
+	case "request-headers.remove":
+		l.Route.HeaderMutation.RequestRemove = splitList(strings.ToLower(value))
+	case "response-headers.remove":
+		l.Route.HeaderMutation.ResponseRemove = splitList(strings.ToLower(value))
+	case "https-redirect":
+		if redirect, err := strconv.ParseBool(value); err == nil {
+			l.Route.HTTPS.Redirect = redirect
+		}
+	case "https-redirect-code":
+		setUint32(&l.Route.HTTPS.RedirectCode, value)
+	case "hsts":
+		l.Route.HTTPS.HSTS = strings.TrimSpace(value)
 	case "domain":
 		l.Route.Domain = value
 	case "extra-domains":
@@ -61,42 +475,239 @@ func (l *ServiceLabel) setRouteProp(property, value string) {
 	}
 }
 
-var serviceLabelRegex = regexp.MustCompile(`(?Uim)envoy\.(?P<type>\S+)\.(?P<property>\S+$)`)
+// parseRateLimitUnit accepts second, minute, hour or a duration like 10s, anything else results in an invalid unit
+func parseRateLimitUnit(value string) time.Duration {
+	switch strings.ToLower(value) {
+	case "second":
+		return time.Second
+	case "minute":
+		return time.Minute
+	case "hour":
+		return time.Hour
+	}
+
+	unit, _ := time.ParseDuration(value)
+
+	return unit
+}
+
+// parseRateLimitDescriptors reads descriptors separated by a semicolon, each having comma separated entries like
+// "remote_address;generic_key=api,header:x-api-key=api_key"
+func parseRateLimitDescriptors(value string) (descriptors []RateLimitDescriptor) {
+	for _, d := range strings.Split(value, ";") {
+		var descriptor RateLimitDescriptor
+		for _, entry := range splitList(d) {
+			entryType, entryValue, _ := strings.Cut(entry, "=")
+			entryType, name, _ := strings.Cut(entryType, ":")
+			descriptor = append(descriptor, RateLimitEntry{
+				Type:  strings.ToLower(strings.TrimSpace(entryType)),
+				Name:  strings.TrimSpace(name),
+				Value: strings.TrimSpace(entryValue),
+			})
+		}
+
+		if len(descriptor) > 0 {
+			descriptors = append(descriptors, descriptor)
+		}
+	}
+
+	return descriptors
+}
+
+// setHeader stores header names in lowercase, as envoy treats them case-insensitive
+func setHeader(headers map[string]string, name, value string) map[string]string {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers[strings.ToLower(name)] = value
+
+	return headers
+}
+
+// setRequestMatcher replaces the matcher with the same name, so an indexed label group overrides its defaults
+// Header names are case-insensitive while query parameter names are not, hence the sameName comparison
+func setRequestMatcher(matchers []RequestMatcher, m RequestMatcher, sameName func(a, b string) bool) []RequestMatcher {
+	for i := range matchers {
+		if sameName(matchers[i].Name, m.Name) {
+			matchers[i] = m
+			return matchers
+		}
+	}
+
+	return append(matchers, m)
+}
+
+// splitList splits comma separated label values and trims any whitespace
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+func cutPrefixFold(s, prefix string) (after string, found bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+
+	return s[len(prefix):], true
+}
+
+// parseRequestMatcher reads values like "prefix:beta" or "present", a value without a match type is matched exactly
+func parseRequestMatcher(name, value string) RequestMatcher {
+	if strings.EqualFold(value, string(ValueMatchPresent)) {
+		return RequestMatcher{Name: name, Match: ValueMatchPresent}
+	}
+
+	if matchType, matchValue, found := strings.Cut(value, ":"); found {
+		switch m := ValueMatch(strings.ToLower(matchType)); m {
+		case ValueMatchExact, ValueMatchPrefix, ValueMatchRegex:
+			return RequestMatcher{Name: name, Match: m, Value: matchValue}
+		}
+	}
+
+	return RequestMatcher{Name: name, Match: ValueMatchExact, Value: value}
+}
+
+var (
+	tlsIssuerRegex           = regexp.MustCompile(`^[a-z0-9-]+$`)
+	serviceLabelRegex        = regexp.MustCompile(`(?Uim)envoy\.(?P<type>\S+)\.(?P<property>\S+$)`)
+	indexedServiceLabelRegex = regexp.MustCompile(`(?Uim)envoy\.(?P<index>\d+)\.(?P<type>\S+)\.(?P<property>\S+$)`)
+)
 
 // NewServiceLabel will create an ServiceLabel with default values
 // Note that some values like the timeouts are based upon best practices for running at the edge: https://www.envoyproxy.io/docs/envoy/latest/configuration/best_practices/edge
 func NewServiceLabel() ServiceLabel {
 	return ServiceLabel{
-		ServiceEndpoint{
+		Endpoint: ServiceEndpoint{
 			RequestTimeout: 15 * time.Second,
 			Protocol:       types.SocketAddress_TCP,
 			Port:           types.SocketAddress_PortValue{PortValue: 0},
+			HealthCheck: ServiceHealthCheck{
+				Interval:           10 * time.Second,
+				Timeout:            2 * time.Second,
+				HealthyThreshold:   2,
+				UnhealthyThreshold: 3,
+			},
 		},
-		ServiceRoute{
+		Route: ServiceRoute{
 			ExtraDomains: []string{},
-			PathPrefix:   "/",
+			Path:         "/",
+			PathMatch:    PathMatchPrefix,
+			Weight:       1,
+			Mirror:       ServiceMirror{Percent: 100},
+			RateLimit:    ServiceRateLimit{Unit: time.Second},
+			ExtAuthz:     ServiceExtAuthz{Mode: ExtAuthzModeHTTP},
+			HTTPS:        NewServiceHTTPS(),
+			// Retrying at another upstream covers tasks that are stopped during rolling updates. Reset is left out, as
+			// the upstream may have processed the request already and a POST or PUT shouldn't be replayed
+			Retry: ServiceRetry{
+				On:      []string{"connect-failure", "refused-stream"},
+				Retries: 2,
+			},
 		},
+		TLS: ServiceTLS{Issuer: TLSIssuerACME},
 	}
 }
 
-// ParseServiceLabels constructs a ServiceLabel with default values and passed overrides
-func ParseServiceLabels(labels map[string]string) *ServiceLabel {
-	s := NewServiceLabel()
+// NewServiceHTTPS redirects all plain HTTP traffic permanently and leaves HSTS up to the service
+func NewServiceHTTPS() ServiceHTTPS {
+	const MovedPermanently = 301
+
+	return ServiceHTTPS{Redirect: true, RedirectCode: MovedPermanently}
+}
+
+// ParseServiceLabels constructs a ServiceLabel per label group with default values and passed overrides.
+// Unindexed labels (envoy.route.domain) form a single group. When indexed labels (envoy.0.route.domain) are present,
+// each index becomes a group on its own that uses the unindexed labels as its defaults.
+func ParseServiceLabels(labels map[string]string) []*ServiceLabel {
+	var defaults []labelProperty
+	groups := make(map[int][]labelProperty)
+
 	for key, value := range labels {
-		if !serviceLabelRegex.MatchString(key) {
+		if matches := indexedServiceLabelRegex.FindStringSubmatch(key); matches != nil {
+			index, err := strconv.Atoi(matches[1])
+			if err != nil {
+				continue
+			}
+
+			groups[index] = append(groups[index], labelProperty{matches[2], matches[3], value})
 			continue
 		}
 
-		matches := serviceLabelRegex.FindStringSubmatch(key)
-		switch strings.ToLower(matches[1]) { // type
+		if matches := serviceLabelRegex.FindStringSubmatch(key); matches != nil {
+			defaults = append(defaults, labelProperty{matches[1], matches[2], value})
+		}
+	}
+
+	if len(groups) == 0 {
+		s := NewServiceLabel()
+		s.setProps(defaults)
+		s.Route.normalizePath()
+
+		return []*ServiceLabel{&s}
+	}
+
+	indexes := make([]int, 0, len(groups))
+	for index := range groups {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	parsed := make([]*ServiceLabel, 0, len(indexes))
+	for _, index := range indexes {
+		s := NewServiceLabel()
+		s.Index = strconv.Itoa(index)
+		s.setProps(defaults)
+		s.setProps(groups[index])
+		s.Route.normalizePath()
+
+		parsed = append(parsed, &s)
+	}
+
+	return parsed
+}
+
+// labelProperty is a single envoy.<type>.<property>=<value> label
+type labelProperty struct {
+	labelType string
+	property  string
+	value     string
+}
+
+func (l *ServiceLabel) setProps(properties []labelProperty) {
+	for _, p := range properties {
+		switch strings.ToLower(p.labelType) {
 		case "endpoint":
-			s.setEndpointProp(matches[2], value)
+			l.setEndpointProp(p.property, p.value)
 		case "route":
-			s.setRouteProp(matches[2], value)
+			l.setRouteProp(p.property, p.value)
+		case "tls":
+			l.setTLSProp(p.property, p.value)
 		}
 	}
+}
+
+// normalizePath makes sure prefix and exact paths start with a slash, regular expressions are kept as they are
+func (r *ServiceRoute) normalizePath() {
+	if r.PathMatch == PathMatchRegex {
+		return
+	}
 
-	return &s
+	r.Path = fmt.Sprintf("/%s", strings.TrimPrefix(r.Path, "/"))
+}
+
+// ClusterName gives the name of the cluster for this label group, indexed groups are suffixed with their index
+func (l *ServiceLabel) ClusterName(serviceName string) string {
+	if l.Index == "" {
+		return serviceName
+	}
+
+	return fmt.Sprintf("%s_%s", serviceName, l.Index)
 }
 
 func (l ServiceLabel) Validate() error {
@@ -112,15 +723,453 @@ func (l ServiceLabel) Validate() error {
 		return errors.New("the endpoint.timeout can't be a negative number")
 	}
 
-	if !valid.IsDNSName(l.Route.Domain) {
+	if err := l.Endpoint.Outlier.validate(); err != nil {
+		return err
+	}
+
+	if err := l.Endpoint.HealthCheck.validate(); err != nil {
+		return err
+	}
+
+	if err := l.validateLoadBalancing(); err != nil {
+		return err
+	}
+
+	if !isDomainName(l.Route.Domain) {
 		return errors.New("the route.domain is not a valid DNS name")
 	}
 
 	for i := range l.Route.ExtraDomains {
-		if !valid.IsDNSName(l.Route.ExtraDomains[i]) {
+		if !isDomainName(l.Route.ExtraDomains[i]) {
 			return errors.New("the route.extra-domains contains an invalid DNS name")
 		}
 	}
 
+	if err := l.Route.validatePath(); err != nil {
+		return err
+	}
+
+	if err := validateRequestMatchers("route.headers", l.Route.Headers); err != nil {
+		return err
+	}
+
+	if err := validateRequestMatchers("route.query", l.Route.QueryParameters); err != nil {
+		return err
+	}
+
+	if err := l.Route.validateRewrite(); err != nil {
+		return err
+	}
+
+	if l.Route.Mirror.Percent < 0 || l.Route.Mirror.Percent > 100 {
+		return errors.New("the route.mirror-percent should be between 0 and 100")
+	}
+
+	if err := l.Route.RateLimit.validate(); err != nil {
+		return err
+	}
+
+	if err := l.Route.Cors.validate(); err != nil {
+		return err
+	}
+
+	if err := validateCIDRs("route.allow-cidrs", l.Route.AllowCIDRs); err != nil {
+		return err
+	}
+
+	if err := validateCIDRs("route.deny-cidrs", l.Route.DenyCIDRs); err != nil {
+		return err
+	}
+
+	if l.Route.ExtAuthz.Mode != ExtAuthzModeHTTP && l.Route.ExtAuthz.Mode != ExtAuthzModeGRPC {
+		return fmt.Errorf("the route.ext-authz-mode %s is not one of http or grpc", l.Route.ExtAuthz.Mode)
+	}
+
+	if err := l.Route.JWT.validate(); err != nil {
+		return err
+	}
+
+	if err := l.Route.HeaderMutation.validate(); err != nil {
+		return err
+	}
+
+	if err := l.Route.HTTPS.validate(); err != nil {
+		return err
+	}
+
+	if !tlsIssuerRegex.MatchString(l.TLS.Issuer) {
+		return errors.New("the tls.issuer should only contain lowercase letters, digits and dashes")
+	}
+
+	return l.Route.Retry.validate()
+}
+
+func (r ServiceRateLimit) validate() error {
+	const MinimalFillInterval = 50 * time.Millisecond
+	if err := validateRateLimitDescriptors(r.Descriptors); err != nil {
+		return err
+	}
+
+	if r.Requests == 0 {
+		return nil
+	}
+
+	if r.Unit < MinimalFillInterval {
+		return errors.New("the route.ratelimit.unit should be second, minute, hour or a duration of at least 50ms")
+	}
+
+	if r.Burst != 0 && r.Burst < r.Requests {
+		return errors.New("the route.ratelimit.burst can't be lower than the route.ratelimit.requests-per-unit")
+	}
+
+	return nil
+}
+
+// LoadBalancingPolicy resolves the lb-policy, hashing requests for affinity only works with a consistent hashing policy
+func (l ServiceLabel) LoadBalancingPolicy() LbPolicy {
+	if l.Endpoint.LbPolicy != "" {
+		return l.Endpoint.LbPolicy
+	}
+
+	if l.Route.Affinity.enabled() {
+		return LbPolicyRingHash
+	}
+
+	return LbPolicyRoundRobin
+}
+
+func (l ServiceLabel) validateLoadBalancing() error {
+	switch l.LoadBalancingPolicy() {
+	case LbPolicyRoundRobin, LbPolicyLeastRequest, LbPolicyRandom:
+		if l.Route.Affinity.enabled() {
+			return errors.New("the route.sticky-cookie and route.hash-header require a ring-hash or maglev endpoint.lb-policy")
+		}
+	case LbPolicyRingHash, LbPolicyMaglev:
+	default:
+		return fmt.Errorf("the endpoint.lb-policy %s is not one of round-robin, least-request, random, ring-hash or maglev", l.Endpoint.LbPolicy)
+	}
+
+	if strings.ContainsAny(l.Route.Affinity.Cookie, " ;=,\"") {
+		return errors.New("the route.sticky-cookie is not a valid cookie name")
+	}
+
+	if l.Route.Affinity.CookieTTL < 0 {
+		return errors.New("the route.sticky-cookie-ttl can't be a negative number")
+	}
+
+	return nil
+}
+
+func (r ServiceRoute) validatePath() error {
+	switch r.PathMatch {
+	case PathMatchPrefix, PathMatchExact:
+	case PathMatchRegex:
+		// Envoy uses RE2, which is the same syntax as the regexp package
+		if _, err := regexp.Compile(r.Path); err != nil {
+			return errors.New("the route.path is not a valid regular expression")
+		}
+	case PathMatchPathSeparatedPrefix:
+		if strings.HasSuffix(r.Path, "/") || strings.ContainsAny(r.Path, "?#") {
+			return errors.New("the route.path can't end with a slash or contain a query when using path-separated-prefix")
+		}
+	default:
+		return fmt.Errorf("the route.match %s is not one of prefix, exact, regex or path-separated-prefix", r.PathMatch)
+	}
+
+	return nil
+}
+
+func validateRequestMatchers(label string, matchers []RequestMatcher) error {
+	for _, m := range matchers {
+		if m.Name == "" {
+			return fmt.Errorf("the %s label is missing a name", label)
+		}
+
+		if m.Match != ValueMatchRegex {
+			continue
+		}
+
+		if _, err := regexp.Compile(m.Value); err != nil {
+			return fmt.Errorf("the %s.%s value is not a valid regular expression", label, m.Name)
+		}
+	}
+
+	return nil
+}
+
+func (r ServiceRoute) validateRewrite() error {
+	if r.Rewrite.Prefix != "" && r.Rewrite.RegexPattern != "" {
+		return errors.New("the route.prefix-rewrite and route.regex-rewrite can't be used together")
+	}
+
+	if r.Rewrite.Prefix != "" && r.PathMatch == PathMatchRegex {
+		return errors.New("the route.prefix-rewrite can't be used with a regex route.match, use route.regex-rewrite instead")
+	}
+
+	if r.Rewrite.RegexPattern != "" {
+		if _, err := regexp.Compile(r.Rewrite.RegexPattern); err != nil {
+			return errors.New("the route.regex-rewrite pattern is not a valid regular expression")
+		}
+	}
+
+	if r.Rewrite.Host != "" && !valid.IsDNSName(r.Rewrite.Host) {
+		return errors.New("the route.host-rewrite is not a valid DNS name")
+	}
+
+	return nil
+}
+
+func validateRateLimitDescriptors(descriptors []RateLimitDescriptor) error {
+	for _, descriptor := range descriptors {
+		for _, entry := range descriptor {
+			switch entry.Type {
+			case "remote_address", "destination_cluster":
+			case "generic_key":
+				if entry.Value == "" {
+					return errors.New("the route.ratelimit.descriptors generic_key requires a value like generic_key=api")
+				}
+			case "header":
+				if entry.Name == "" || entry.Value == "" {
+					return errors.New("the route.ratelimit.descriptors header requires a name and key like header:x-api-key=api_key")
+				}
+			default:
+				return fmt.Errorf("the route.ratelimit.descriptors entry %s is not one of remote_address, destination_cluster, generic_key or header", entry.Type)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c ServiceCors) validate() error {
+	if !c.enabled() {
+		if len(c.AllowMethods) > 0 || len(c.AllowHeaders) > 0 || len(c.ExposeHeaders) > 0 || c.MaxAge != 0 || c.AllowCredentials {
+			return errors.New("the route.cors labels require route.cors.allow-origins")
+		}
+
+		return nil
+	}
+
+	for _, origin := range c.AllowOrigins {
+		if origin == "*" && c.AllowCredentials {
+			return errors.New("the route.cors.allow-credentials can't be used when route.cors.allow-origins contains *")
+		}
+
+		if m := parseRequestMatcher("origin", origin); m.Match == ValueMatchRegex {
+			if _, err := regexp.Compile(m.Value); err != nil {
+				return fmt.Errorf("the route.cors.allow-origins %s is not a valid regular expression", m.Value)
+			}
+		}
+	}
+
+	if c.MaxAge < 0 {
+		return errors.New("the route.cors.max-age can't be a negative number")
+	}
+
+	return nil
+}
+
+func validateCIDRs(label string, cidrs []string) error {
+	for _, cidr := range cidrs {
+		if _, err := parseCIDR(cidr); err != nil {
+			return fmt.Errorf("the %s contains an invalid IP address or CIDR %s", label, cidr)
+		}
+	}
+
+	return nil
+}
+
+// IsWildcardDomain tells if the domain covers all subdomains of a single level, like *.example.com
+func IsWildcardDomain(domain string) bool {
+	return strings.HasPrefix(domain, "*.")
+}
+
+// isDomainName accepts DNS names and wildcard domains, as long as the wildcard is not directly below a TLD
+func isDomainName(domain string) bool {
+	if IsWildcardDomain(domain) {
+		domain = strings.TrimPrefix(domain, "*.")
+		if !strings.Contains(domain, ".") {
+			return false
+		}
+	}
+
+	return valid.IsDNSName(domain)
+}
+
+// parseCIDR accepts CIDRs and plain IP addresses, which are treated as a single host range
+func parseCIDR(value string) (*net.IPNet, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(value)
+
+	return network, err
+}
+
+func (j ServiceJWT) validate() error {
+	if !j.enabled() {
+		if len(j.Audiences) > 0 || j.ForwardPayloadHeader != "" {
+			return errors.New("the route.jwt labels require route.jwt.issuer and route.jwt.jwks-uri")
+		}
+
+		return nil
+	}
+
+	if j.Issuer == "" || j.JwksURI == "" {
+		return errors.New("the route.jwt labels require route.jwt.issuer and route.jwt.jwks-uri")
+	}
+
+	if _, _, err := parseJwksURI(j.JwksURI); err != nil {
+		return err
+	}
+
+	if strings.ContainsAny(j.ForwardPayloadHeader, " :") {
+		return errors.New("the route.jwt.forward-payload-header is not a valid header name")
+	}
+
+	return nil
+}
+
+// parseJwksURI returns the host and port to fetch the keys from, only https is allowed so the host can be verified
+func parseJwksURI(uri string) (host string, port uint32, err error) {
+	const HTTPSPort = 443
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return "", 0, errors.New("the route.jwt.jwks-uri should be an https URL")
+	}
+
+	port = HTTPSPort
+	if u.Port() != "" {
+		p, err := strconv.ParseUint(u.Port(), 10, 16)
+		if err != nil {
+			return "", 0, errors.New("the route.jwt.jwks-uri contains an invalid port")
+		}
+		port = uint32(p)
+	}
+
+	return u.Hostname(), port, nil
+}
+
+func (h ServiceHeaderMutation) validate() error {
+	for name := range h.RequestAdd {
+		if err := validateMutableHeader("route.request-headers.add", name); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range h.RequestRemove {
+		if err := validateMutableHeader("route.request-headers.remove", name); err != nil {
+			return err
+		}
+	}
+
+	for name := range h.ResponseAdd {
+		if err := validateMutableHeader("route.response-headers.add", name); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range h.ResponseRemove {
+		if err := validateMutableHeader("route.response-headers.remove", name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateMutableHeader rejects the headers that envoy won't let routes modify
+func validateMutableHeader(label, name string) error {
+	if name == "" || name == "host" || strings.HasPrefix(name, ":") || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("the %s label contains the header %q which can't be modified", label, name)
+	}
+
+	return nil
+}
+
+func (h ServiceHTTPS) validate() error {
+	if h.RedirectCode != 301 && h.RedirectCode != 308 {
+		return errors.New("the route.https-redirect-code should be 301 or 308")
+	}
+
+	if h.HSTS == "" {
+		return nil
+	}
+
+	maxAge, _, _ := strings.Cut(h.HSTS, ";")
+	seconds, found := cutPrefixFold(strings.TrimSpace(maxAge), "max-age=")
+	if _, err := strconv.ParseUint(seconds, 10, 64); !found || err != nil {
+		return errors.New("the route.hsts should start with max-age=<seconds>")
+	}
+
+	return nil
+}
+
+// retryConditions are the x-envoy-retry-on and x-envoy-retry-grpc-on values envoy accepts
+var retryConditions = map[string]bool{
+	"5xx": true, "gateway-error": true, "reset": true, "reset-before-request": true, "connect-failure": true,
+	"envoy-ratelimited": true, "retriable-4xx": true, "refused-stream": true, "retriable-status-codes": true,
+	"retriable-headers": true, "http3-post-connect-failure": true, "cancelled": true, "deadline-exceeded": true,
+	"internal": true, "resource-exhausted": true, "unavailable": true,
+}
+
+func (r ServiceRetry) validate() error {
+	if r.PerTryTimeout < 0 {
+		return errors.New("the route.per-try-timeout can't be a negative number")
+	}
+
+	hasStatusCodeCondition := false
+	for _, condition := range r.On {
+		if !retryConditions[condition] {
+			return fmt.Errorf("the route.retry-on condition %s is not supported", condition)
+		}
+
+		hasStatusCodeCondition = hasStatusCodeCondition || condition == "retriable-status-codes"
+	}
+
+	for _, code := range r.RetriableStatusCodes {
+		if code < 100 || code > 599 {
+			return errors.New("the route.retriable-status-codes contains an invalid HTTP status code")
+		}
+	}
+
+	if len(r.RetriableStatusCodes) > 0 && !hasStatusCodeCondition {
+		return errors.New("the route.retriable-status-codes require retriable-status-codes in route.retry-on")
+	}
+
+	return nil
+}
+
+func (h ServiceHealthCheck) validate() error {
+	if h.Path == "" {
+		return nil
+	}
+
+	if h.Interval <= 0 || h.Timeout <= 0 {
+		return errors.New("the endpoint.healthcheck interval and timeout should be positive durations")
+	}
+
+	if h.HealthyThreshold == 0 || h.UnhealthyThreshold == 0 {
+		return errors.New("the endpoint.healthcheck thresholds should be at least 1")
+	}
+
+	return nil
+}
+
+func (o ServiceOutlierDetection) validate() error {
+	if o.Interval < 0 || o.BaseEjectionTime < 0 {
+		return errors.New("the endpoint.outlier durations can't be negative numbers")
+	}
+
+	if o.MaxEjectionPercent > 100 {
+		return errors.New("the endpoint.outlier.max-ejection-percent can't be more than 100")
+	}
+
 	return nil
 }
@@ -11,7 +11,7 @@ import (
 func TestServiceLabelDefaults(t *testing.T) {
 	defaults := NewServiceLabel()
 
-	assert.Equal(t, defaults.Route.PathPrefix, "/")
+	assert.Equal(t, defaults.Route.Path, "/")
 	assert.Check(t, len(defaults.Route.ExtraDomains) == 0)
 	assert.Equal(t, defaults.Route.Domain, "")
 
@@ -20,10 +20,25 @@ func TestServiceLabelDefaults(t *testing.T) {
 }
 
 func TestServiceLabelAutoPathPrefix(t *testing.T) {
-	label := NewServiceLabel()
-	label.setRouteProp("path", "api")
+	labels := make(map[string]string)
+	labels["envoy.route.path"] = "api"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.Equal(t, parsed.Route.Path, "/api")
+}
+
+func TestServiceLabelRegexPathKeepsPattern(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.endpoint.port"] = "80"
+	labels["envoy.route.domain"] = "example.com"
+	labels["envoy.route.path"] = "^/api/.*"
+	labels["envoy.route.match"] = "regex"
+
+	parsed := ParseServiceLabels(labels)[0]
 
-	assert.Equal(t, label.Route.PathPrefix, "/api")
+	assert.Equal(t, parsed.Route.Path, "^/api/.*")
+	assert.NilError(t, parsed.Validate())
 }
 
 func TestServiceLabelInvalidDNS(t *testing.T) {
@@ -34,6 +49,23 @@ func TestServiceLabelInvalidDNS(t *testing.T) {
 	assert.Error(t, label.Validate(), "the route.domain is not a valid DNS name")
 }
 
+func TestServiceLabelAcceptsWildcardDomains(t *testing.T) {
+	label := NewServiceLabel()
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.Domain = "*.customers.example.com"
+	label.Route.ExtraDomains = []string{"*.example.com"}
+
+	assert.NilError(t, label.Validate())
+}
+
+func TestServiceLabelWildcardShouldNotCoverATopLevelDomain(t *testing.T) {
+	label := NewServiceLabel()
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.Domain = "*.com"
+
+	assert.Error(t, label.Validate(), "the route.domain is not a valid DNS name")
+}
+
 func TestServiceLabelInvalidTimeout(t *testing.T) {
 	label := NewServiceLabel()
 	label.Route.Domain = "example"
@@ -47,7 +79,519 @@ func TestParseServiceLabelsEndpointTimeout(t *testing.T) {
 	labels := make(map[string]string)
 	labels["envoy.endpoint.timeout"] = "30m"
 
-	parsed := ParseServiceLabels(labels)
+	parsed := ParseServiceLabels(labels)[0]
 
 	assert.Equal(t, parsed.Endpoint.RequestTimeout.Seconds(), float64(1800))
 }
+
+func TestParseServiceLabelsPathMatch(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.path"] = "/api"
+	labels["envoy.route.match"] = "Path-Separated-Prefix"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.Equal(t, parsed.Route.Path, "/api")
+	assert.Equal(t, parsed.Route.PathMatch, PathMatchPathSeparatedPrefix)
+}
+
+func TestServiceLabelUnknownPathMatch(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.PathMatch = "suffix"
+
+	assert.Error(t, label.Validate(), "the route.match suffix is not one of prefix, exact, regex or path-separated-prefix")
+}
+
+func TestServiceLabelInvalidRegexPath(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.PathMatch = PathMatchRegex
+	label.Route.Path = "/api/(v1"
+
+	assert.Error(t, label.Validate(), "the route.path is not a valid regular expression")
+}
+
+func TestServiceLabelPathSeparatedPrefixTrailingSlash(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.PathMatch = PathMatchPathSeparatedPrefix
+	label.Route.Path = "/api/"
+
+	assert.Error(t, label.Validate(), "the route.path can't end with a slash or contain a query when using path-separated-prefix")
+}
+
+func TestParseServiceLabelsRegexRewrite(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.regex-rewrite"] = `^/billing/(.*)$ /\1`
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.Equal(t, parsed.Route.Rewrite.RegexPattern, "^/billing/(.*)$")
+	assert.Equal(t, parsed.Route.Rewrite.RegexSubstitution, `/\1`)
+}
+
+func TestServiceLabelConflictingRewrites(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.Rewrite.Prefix = "/"
+	label.Route.Rewrite.RegexPattern = "^/billing"
+
+	assert.Error(t, label.Validate(), "the route.prefix-rewrite and route.regex-rewrite can't be used together")
+}
+
+func TestServiceLabelPrefixRewriteWithRegexMatch(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.PathMatch = PathMatchRegex
+	label.Route.Path = "/billing/.*"
+	label.Route.Rewrite.Prefix = "/"
+
+	assert.Error(t, label.Validate(), "the route.prefix-rewrite can't be used with a regex route.match, use route.regex-rewrite instead")
+}
+
+func TestParseServiceLabelsWithoutIndexIsSingleGroup(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.endpoint.port"] = "80"
+	labels["envoy.route.domain"] = "example.com"
+
+	parsed := ParseServiceLabels(labels)
+
+	assert.Equal(t, len(parsed), 1)
+	assert.Equal(t, parsed[0].Index, "")
+	assert.Equal(t, parsed[0].ClusterName("frontend"), "frontend")
+}
+
+func TestParseServiceLabelsIndexedGroupsInheritUnindexedLabels(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.endpoint.timeout"] = "30s"
+	labels["envoy.route.domain"] = "example.com"
+	labels["envoy.1.endpoint.port"] = "9090"
+	labels["envoy.1.route.domain"] = "metrics.example.com"
+	labels["envoy.0.endpoint.port"] = "80"
+
+	parsed := ParseServiceLabels(labels)
+
+	assert.Equal(t, len(parsed), 2)
+	assert.Equal(t, parsed[0].ClusterName("api"), "api_0")
+	assert.Equal(t, parsed[0].Endpoint.Port.PortValue, uint32(80))
+	assert.Equal(t, parsed[0].Route.Domain, "example.com")
+	assert.Equal(t, parsed[0].Endpoint.RequestTimeout, 30*time.Second)
+	assert.Equal(t, parsed[1].ClusterName("api"), "api_1")
+	assert.Equal(t, parsed[1].Endpoint.Port.PortValue, uint32(9090))
+	assert.Equal(t, parsed[1].Route.Domain, "metrics.example.com")
+	assert.Equal(t, parsed[1].Endpoint.RequestTimeout, 30*time.Second)
+}
+
+func TestParseServiceLabelsWeight(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.weight"] = "25"
+
+	assert.Equal(t, NewServiceLabel().Route.Weight, uint32(1))
+	assert.Equal(t, ParseServiceLabels(labels)[0].Route.Weight, uint32(25))
+}
+
+func TestParseServiceLabelsRequestMatchers(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.headers.X-Tenant"] = "beta"
+	labels["envoy.route.query.preview"] = "present"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.DeepEqual(t, parsed.Route.Headers, []RequestMatcher{{Name: "X-Tenant", Match: ValueMatchExact, Value: "beta"}})
+	assert.DeepEqual(t, parsed.Route.QueryParameters, []RequestMatcher{{Name: "preview", Match: ValueMatchPresent}})
+}
+
+func TestParseServiceLabelsIndexedRequestMatchersOverrideDefaults(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.headers.x-tenant"] = "alpha"
+	labels["envoy.route.query.preview"] = "present"
+	labels["envoy.0.route.headers.X-Tenant"] = "beta"
+	labels["envoy.0.route.query.preview"] = "exact:1"
+	labels["envoy.0.route.query.Preview"] = "present"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.DeepEqual(t, parsed.Route.Headers, []RequestMatcher{{Name: "X-Tenant", Match: ValueMatchExact, Value: "beta"}})
+	assert.DeepEqual(t, sortedRequestMatchers(parsed.Route.QueryParameters), []RequestMatcher{
+		{Name: "Preview", Match: ValueMatchPresent},
+		{Name: "preview", Match: ValueMatchExact, Value: "1"},
+	})
+}
+
+func TestParseRequestMatcherTypes(t *testing.T) {
+	assert.Equal(t, parseRequestMatcher("x", "prefix:be"), RequestMatcher{Name: "x", Match: ValueMatchPrefix, Value: "be"})
+	assert.Equal(t, parseRequestMatcher("x", "regex:b.*"), RequestMatcher{Name: "x", Match: ValueMatchRegex, Value: "b.*"})
+	assert.Equal(t, parseRequestMatcher("x", "exact:present"), RequestMatcher{Name: "x", Match: ValueMatchExact, Value: "present"})
+	assert.Equal(t, parseRequestMatcher("x", "urn:beta"), RequestMatcher{Name: "x", Match: ValueMatchExact, Value: "urn:beta"})
+}
+
+func TestServiceLabelInvalidHeaderRegex(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.Headers = []RequestMatcher{{Name: "x-tenant", Match: ValueMatchRegex, Value: "(beta"}}
+
+	assert.Error(t, label.Validate(), "the route.headers.x-tenant value is not a valid regular expression")
+}
+
+func TestServiceLabelInvalidMirrorPercent(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.Mirror = ServiceMirror{Cluster: "api-next", Percent: 150}
+
+	assert.Error(t, label.Validate(), "the route.mirror-percent should be between 0 and 100")
+}
+
+func TestServiceLabelDefaultRetryPolicy(t *testing.T) {
+	defaults := NewServiceLabel()
+
+	assert.DeepEqual(t, defaults.Route.Retry.On, []string{"connect-failure", "refused-stream"})
+	assert.Equal(t, defaults.Route.Retry.Retries, uint32(2))
+}
+
+func TestParseServiceLabelsOptIntoRetryOnReset(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.retry-on"] = "connect-failure,refused-stream,reset"
+
+	assert.DeepEqual(t, ParseServiceLabels(labels)[0].Route.Retry.On, []string{"connect-failure", "refused-stream", "reset"})
+}
+
+func TestParseServiceLabelsRetryPolicy(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.retry-on"] = "5xx, retriable-status-codes"
+	labels["envoy.route.retries"] = "3"
+	labels["envoy.route.per-try-timeout"] = "250ms"
+	labels["envoy.route.retriable-status-codes"] = "409,425"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.DeepEqual(t, parsed.Route.Retry.On, []string{"5xx", "retriable-status-codes"})
+	assert.Equal(t, parsed.Route.Retry.Retries, uint32(3))
+	assert.Equal(t, parsed.Route.Retry.PerTryTimeout, 250*time.Millisecond)
+	assert.DeepEqual(t, parsed.Route.Retry.RetriableStatusCodes, []uint32{409, 425})
+}
+
+func TestServiceLabelUnknownRetryCondition(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.Retry.On = []string{"sometimes"}
+
+	assert.Error(t, label.Validate(), "the route.retry-on condition sometimes is not supported")
+}
+
+func TestServiceLabelRetriableStatusCodesRequireCondition(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.Retry.RetriableStatusCodes = []uint32{503}
+
+	assert.Error(t, label.Validate(), "the route.retriable-status-codes require retriable-status-codes in route.retry-on")
+}
+
+func TestParseServiceLabelsOutlierDetection(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.endpoint.max-requests"] = "250"
+	labels["envoy.endpoint.outlier.consecutive-5xx"] = "3"
+	labels["envoy.endpoint.outlier.interval"] = "5s"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.Equal(t, parsed.Endpoint.CircuitBreaker.MaxRequests, uint32(250))
+	assert.Equal(t, parsed.Endpoint.Outlier.Consecutive5xx, uint32(3))
+	assert.Equal(t, parsed.Endpoint.Outlier.Interval, 5*time.Second)
+}
+
+func TestServiceLabelInvalidMaxEjectionPercent(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Endpoint.Outlier.MaxEjectionPercent = 101
+
+	assert.Error(t, label.Validate(), "the endpoint.outlier.max-ejection-percent can't be more than 100")
+}
+
+func TestParseServiceLabelsHealthCheck(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.endpoint.healthcheck.path"] = "health"
+	labels["envoy.endpoint.healthcheck.timeout"] = "500ms"
+	labels["envoy.endpoint.healthcheck.healthy-threshold"] = "1"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.Equal(t, parsed.Endpoint.HealthCheck.Path, "/health")
+	assert.Equal(t, parsed.Endpoint.HealthCheck.Timeout, 500*time.Millisecond)
+	assert.Equal(t, parsed.Endpoint.HealthCheck.HealthyThreshold, uint32(1))
+	assert.Equal(t, parsed.Endpoint.HealthCheck.Interval, 10*time.Second)
+}
+
+func TestServiceLabelInvalidHealthCheckThreshold(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Endpoint.HealthCheck.Path = "/health"
+	label.Endpoint.HealthCheck.UnhealthyThreshold = 0
+
+	assert.Error(t, label.Validate(), "the endpoint.healthcheck thresholds should be at least 1")
+}
+
+func TestParseServiceLabelsSessionAffinity(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.sticky-cookie"] = "backend"
+	labels["envoy.route.sticky-cookie-ttl"] = "1h"
+	labels["envoy.route.hash-header"] = "x-user-id"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.Equal(t, parsed.Route.Affinity.Cookie, "backend")
+	assert.Equal(t, parsed.Route.Affinity.CookieTTL, time.Hour)
+	assert.Equal(t, parsed.Route.Affinity.Header, "x-user-id")
+	assert.Equal(t, parsed.LoadBalancingPolicy(), LbPolicyRingHash)
+}
+
+func TestServiceLabelAffinityRequiresHashingLbPolicy(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Endpoint.LbPolicy = LbPolicyLeastRequest
+	label.Route.Affinity.Cookie = "backend"
+
+	assert.Error(t, label.Validate(), "the route.sticky-cookie and route.hash-header require a ring-hash or maglev endpoint.lb-policy")
+}
+
+func TestServiceLabelInvalidLbPolicy(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Endpoint.LbPolicy = "fastest"
+
+	assert.Error(t, label.Validate(), "the endpoint.lb-policy fastest is not one of round-robin, least-request, random, ring-hash or maglev")
+}
+
+func TestParseServiceLabelsRateLimit(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.ratelimit.requests-per-unit"] = "100"
+	labels["envoy.route.ratelimit.unit"] = "minute"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.Equal(t, parsed.Route.RateLimit.Requests, uint32(100))
+	assert.Equal(t, parsed.Route.RateLimit.Unit, time.Minute)
+	assert.Equal(t, parsed.Route.RateLimit.MaxTokens(), uint32(100))
+}
+
+func TestServiceLabelInvalidRateLimitUnit(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.RateLimit.Requests = 100
+	label.Route.RateLimit.Unit = parseRateLimitUnit("fortnight")
+
+	assert.Error(t, label.Validate(), "the route.ratelimit.unit should be second, minute, hour or a duration of at least 50ms")
+}
+
+func TestParseServiceLabelsRateLimitDescriptors(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.ratelimit.descriptors"] = "remote_address; generic_key=api, header:x-api-key=api_key"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.DeepEqual(t, parsed.Route.RateLimit.Descriptors, []RateLimitDescriptor{
+		{{Type: "remote_address"}},
+		{{Type: "generic_key", Value: "api"}, {Type: "header", Name: "x-api-key", Value: "api_key"}},
+	})
+}
+
+func TestServiceLabelInvalidRateLimitDescriptor(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.RateLimit.Descriptors = parseRateLimitDescriptors("header:x-api-key")
+
+	assert.Error(t, label.Validate(), "the route.ratelimit.descriptors header requires a name and key like header:x-api-key=api_key")
+}
+
+func TestParseServiceLabelsCors(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.cors.allow-origins"] = "https://app.example.com, prefix:https://preview-"
+	labels["envoy.route.cors.allow-methods"] = "get,post"
+	labels["envoy.route.cors.max-age"] = "600"
+	labels["envoy.route.cors.allow-credentials"] = "true"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.DeepEqual(t, parsed.Route.Cors.AllowOrigins, []string{"https://app.example.com", "prefix:https://preview-"})
+	assert.DeepEqual(t, parsed.Route.Cors.AllowMethods, []string{"GET", "POST"})
+	assert.Equal(t, parsed.Route.Cors.MaxAge, 10*time.Minute)
+	assert.Equal(t, parsed.Route.Cors.AllowCredentials, true)
+}
+
+func TestServiceLabelCorsCredentialsWithWildcardOrigin(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.Cors.AllowOrigins = []string{"*"}
+	label.Route.Cors.AllowCredentials = true
+
+	assert.Error(t, label.Validate(), "the route.cors.allow-credentials can't be used when route.cors.allow-origins contains *")
+}
+
+func TestParseServiceLabelsCIDRs(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.allow-cidrs"] = "10.0.0.0/8, 192.168.1.10"
+	labels["envoy.route.deny-cidrs"] = "10.0.13.0/24"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.DeepEqual(t, parsed.Route.AllowCIDRs, []string{"10.0.0.0/8", "192.168.1.10"})
+	assert.DeepEqual(t, parsed.Route.DenyCIDRs, []string{"10.0.13.0/24"})
+}
+
+func TestServiceLabelInvalidCIDR(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.AllowCIDRs = []string{"10.0.0.0/33"}
+
+	assert.Error(t, label.Validate(), "the route.allow-cidrs contains an invalid IP address or CIDR 10.0.0.0/33")
+}
+
+func TestBasicAuthSetUsers(t *testing.T) {
+	basicAuth := ServiceBasicAuth{Config: "staging-users"}
+
+	err := basicAuth.SetUsers([]byte("admin:{SHA}0DPiKuNIrrVmD8IUCuw1hQxNqZc=\n"))
+
+	assert.NilError(t, err)
+	assert.Equal(t, basicAuth.Users, "admin:{SHA}0DPiKuNIrrVmD8IUCuw1hQxNqZc=\n")
+}
+
+func TestBasicAuthSetUsersRejectsOtherHashes(t *testing.T) {
+	basicAuth := ServiceBasicAuth{Config: "staging-users"}
+
+	err := basicAuth.SetUsers([]byte("admin:$apr1$Vq2Rnq9o$y1sWRvGJ3cKxv6Q4vIuIk.\n"))
+
+	assert.Error(t, err, "the route.basic-auth-config staging-users should only contain users with SHA hashed passwords")
+	assert.Equal(t, basicAuth.Users, "")
+}
+
+func TestParseServiceLabelsExtAuthz(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.ext-authz"] = "sso-gateway"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.Equal(t, parsed.Route.ExtAuthz, ServiceExtAuthz{Cluster: "sso-gateway", Mode: ExtAuthzModeHTTP})
+}
+
+func TestServiceLabelInvalidExtAuthzMode(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.ExtAuthz = ServiceExtAuthz{Cluster: "sso-gateway", Mode: "soap"}
+
+	assert.Error(t, label.Validate(), "the route.ext-authz-mode soap is not one of http or grpc")
+}
+
+func TestParseServiceLabelsJWT(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.jwt.issuer"] = "https://auth.example.com/"
+	labels["envoy.route.jwt.audiences"] = "api, billing"
+	labels["envoy.route.jwt.jwks-uri"] = "https://auth.example.com/.well-known/jwks.json"
+	labels["envoy.route.jwt.forward-payload-header"] = "x-jwt-payload"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.DeepEqual(t, parsed.Route.JWT, ServiceJWT{
+		Issuer:               "https://auth.example.com/",
+		Audiences:            []string{"api", "billing"},
+		JwksURI:              "https://auth.example.com/.well-known/jwks.json",
+		ForwardPayloadHeader: "x-jwt-payload",
+	})
+}
+
+func TestServiceLabelJWTRequiresHTTPSJwksURI(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.JWT = ServiceJWT{Issuer: "https://auth.example.com/", JwksURI: "http://auth.example.com/jwks.json"}
+
+	assert.Error(t, label.Validate(), "the route.jwt.jwks-uri should be an https URL")
+}
+
+func TestParseServiceLabelsHeaderMutation(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.request-headers.add.X-Edge-Host"] = "%HOSTNAME%"
+	labels["envoy.route.response-headers.add.x-frame-options"] = "DENY"
+	labels["envoy.route.response-headers.remove"] = "X-Powered-By, server"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.DeepEqual(t, parsed.Route.HeaderMutation.RequestAdd, map[string]string{"x-edge-host": "%HOSTNAME%"})
+	assert.DeepEqual(t, parsed.Route.HeaderMutation.ResponseAdd, map[string]string{"x-frame-options": "DENY"})
+	assert.DeepEqual(t, parsed.Route.HeaderMutation.ResponseRemove, []string{"x-powered-by", "server"})
+}
+
+func TestServiceLabelHostHeaderCannotBeRemoved(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.HeaderMutation.RequestRemove = []string{"host"}
+
+	assert.Error(t, label.Validate(), `the route.request-headers.remove label contains the header "host" which can't be modified`)
+}
+
+func TestParseServiceLabelsHTTPSPolicy(t *testing.T) {
+	labels := make(map[string]string)
+	labels["envoy.route.https-redirect"] = "false"
+	labels["envoy.route.https-redirect-code"] = "308"
+	labels["envoy.route.hsts"] = "max-age=31536000;includeSubDomains;preload"
+
+	parsed := ParseServiceLabels(labels)[0]
+
+	assert.Equal(t, parsed.Route.HTTPS.Redirect, false)
+	assert.Equal(t, parsed.Route.HTTPS.RedirectCode, uint32(308))
+	assert.Equal(t, parsed.Route.HTTPS.HSTS, "max-age=31536000;includeSubDomains;preload")
+}
+
+func TestServiceLabelHTTPSRedirectCodeShouldBePermanent(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.HTTPS.RedirectCode = 302
+
+	assert.Error(t, label.Validate(), "the route.https-redirect-code should be 301 or 308")
+}
+
+func TestServiceLabelHSTSShouldStartWithMaxAge(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.Route.HTTPS.HSTS = "includeSubDomains"
+
+	assert.Error(t, label.Validate(), "the route.hsts should start with max-age=<seconds>")
+}
+
+func TestParseServiceLabelsTLSIssuer(t *testing.T) {
+	assert.Equal(t, ParseServiceLabels(map[string]string{})[0].TLS.Issuer, TLSIssuerACME)
+
+	labels := make(map[string]string)
+	labels["envoy.tls.issuer"] = "Staging"
+
+	assert.Equal(t, ParseServiceLabels(labels)[0].TLS.Issuer, "staging")
+}
+
+func TestServiceLabelInvalidTLSIssuer(t *testing.T) {
+	label := NewServiceLabel()
+	label.Route.Domain = "example.com"
+	label.Endpoint.Port = types.SocketAddress_PortValue{PortValue: 80}
+	label.TLS.Issuer = "lets encrypt"
+
+	assert.Error(t, label.Validate(), "the tls.issuer should only contain lowercase letters, digits and dashes")
+}
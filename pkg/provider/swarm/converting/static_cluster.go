@@ -0,0 +1,123 @@
+package converting
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+)
+
+// StaticGRPCCluster creates a cluster for a service that isn't discovered through swarm labels, like a ratelimit service
+// The address is a host:port combination, the host is resolved by envoy using DNS
+func StaticGRPCCluster(name, address string) (c *cluster.Cluster, err error) {
+	host, portValue, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("the address of the %s cluster is invalid: %w", name, err)
+	}
+
+	port, err := strconv.ParseUint(portValue, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("the port of the %s cluster is invalid: %w", name, err)
+	}
+
+	c = createDNSCluster(name, host, uint32(port))
+	c.TypedExtensionProtocolOptions = createHTTP2ProtocolOptions()
+	if err = c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// JWKSClusterName is the cluster that envoy uses to fetch JSON Web Key Sets from the host of the URI
+func JWKSClusterName(jwksURI string) string {
+	host, port, _ := parseJwksURI(jwksURI)
+
+	return fmt.Sprintf("jwks_%s_%d", strings.ReplaceAll(host, ".", "_"), port)
+}
+
+// DefaultTrustedCA is the CA bundle of the envoy image, used to verify the certificates of JWKS hosts
+const DefaultTrustedCA = "/etc/ssl/certs/ca-certificates.crt"
+
+// JWKSCluster creates a cluster to fetch JSON Web Key Sets over TLS, the host is resolved by envoy using DNS
+// The certificate of the host should be signed by the trusted CA and contain the host as subject alt name
+func JWKSCluster(jwksURI, trustedCA string) (c *cluster.Cluster, err error) {
+	host, port, err := parseJwksURI(jwksURI)
+	if err != nil {
+		return nil, err
+	}
+
+	sanType := auth.SubjectAltNameMatcher_DNS
+	if net.ParseIP(host) != nil {
+		sanType = auth.SubjectAltNameMatcher_IP_ADDRESS
+	}
+
+	tlsContext, err := anypb.New(&auth.UpstreamTlsContext{
+		Sni: host,
+		CommonTlsContext: &auth.CommonTlsContext{
+			ValidationContextType: &auth.CommonTlsContext_ValidationContext{
+				ValidationContext: &auth.CertificateValidationContext{
+					TrustedCa: &core.DataSource{Specifier: &core.DataSource_Filename{Filename: trustedCA}},
+					MatchTypedSubjectAltNames: []*auth.SubjectAltNameMatcher{{
+						SanType: sanType,
+						Matcher: &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: host}},
+					}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c = createDNSCluster(JWKSClusterName(jwksURI), host, port)
+	c.TransportSocket = &core.TransportSocket{
+		Name:       "envoy.transport_sockets.tls",
+		ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: tlsContext},
+	}
+	if err = c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func createDNSCluster(name, host string, port uint32) *cluster.Cluster {
+	const UpstreamConnectTimeout = 2 * time.Second
+
+	return &cluster.Cluster{
+		Name:                 name,
+		ConnectTimeout:       durationpb.New(UpstreamConnectTimeout),
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_STRICT_DNS},
+		LoadAssignment: &endpoint.ClusterLoadAssignment{
+			ClusterName: name,
+			Endpoints: []*endpoint.LocalityLbEndpoints{{
+				LbEndpoints: []*endpoint.LbEndpoint{{
+					HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+						Endpoint: &endpoint.Endpoint{
+							Address: &core.Address{
+								Address: &core.Address_SocketAddress{
+									SocketAddress: &core.SocketAddress{
+										Protocol:      core.SocketAddress_TCP,
+										Address:       host,
+										PortSpecifier: &core.SocketAddress_PortValue{PortValue: port},
+									},
+								},
+							},
+						},
+					},
+				}},
+			}},
+		},
+	}
+}
@@ -0,0 +1,60 @@
+package converting
+
+import (
+	"testing"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	upstreamhttp "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticGRPCCluster(t *testing.T) {
+	c, err := StaticGRPCCluster("global_ratelimit", "ratelimit:8081")
+
+	assert.NoError(t, err)
+	address := c.LoadAssignment.Endpoints[0].LbEndpoints[0].GetEndpoint().Address.GetSocketAddress()
+	assert.Equal(t, "ratelimit", address.Address)
+	assert.Equal(t, uint32(8081), address.GetPortValue())
+	assert.Contains(t, c.TypedExtensionProtocolOptions, "envoy.extensions.upstreams.http.v3.HttpProtocolOptions")
+}
+
+func TestStaticGRPCClusterTalksHTTP2(t *testing.T) {
+	c, err := StaticGRPCCluster("global_ratelimit", "ratelimit:8081")
+	assert.NoError(t, err)
+
+	options := &upstreamhttp.HttpProtocolOptions{}
+	assert.NoError(t, c.TypedExtensionProtocolOptions["envoy.extensions.upstreams.http.v3.HttpProtocolOptions"].UnmarshalTo(options))
+	assert.NoError(t, options.Validate())
+	assert.NotNil(t, options.GetExplicitHttpConfig().GetHttp2ProtocolOptions())
+	assert.Equal(t, "global_ratelimit", c.LoadAssignment.ClusterName)
+	assert.NoError(t, c.Validate())
+}
+
+func TestStaticGRPCClusterRequiresAPort(t *testing.T) {
+	_, err := StaticGRPCCluster("global_ratelimit", "ratelimit")
+
+	assert.Error(t, err)
+}
+
+func TestJWKSCluster(t *testing.T) {
+	c, err := JWKSCluster("https://auth.example.com/.well-known/jwks.json", DefaultTrustedCA)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "jwks_auth_example_com_443", c.Name)
+	assert.Equal(t, "envoy.transport_sockets.tls", c.TransportSocket.Name)
+	assert.Equal(t, uint32(443), c.LoadAssignment.Endpoints[0].LbEndpoints[0].GetEndpoint().Address.GetSocketAddress().GetPortValue())
+}
+
+func TestJWKSClusterVerifiesTheHost(t *testing.T) {
+	c, err := JWKSCluster("https://auth.example.com/.well-known/jwks.json", "/etc/ssl/private-ca.pem")
+	assert.NoError(t, err)
+
+	tlsContext := &auth.UpstreamTlsContext{}
+	assert.NoError(t, c.TransportSocket.GetTypedConfig().UnmarshalTo(tlsContext))
+	validation := tlsContext.GetCommonTlsContext().GetValidationContext()
+	assert.Equal(t, "auth.example.com", tlsContext.Sni)
+	assert.Equal(t, "/etc/ssl/private-ca.pem", validation.GetTrustedCa().GetFilename())
+	assert.Len(t, validation.MatchTypedSubjectAltNames, 1)
+	assert.Equal(t, auth.SubjectAltNameMatcher_DNS, validation.MatchTypedSubjectAltNames[0].SanType)
+	assert.Equal(t, "auth.example.com", validation.MatchTypedSubjectAltNames[0].Matcher.GetExact())
+}
@@ -2,22 +2,149 @@ package converting
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	rbacconfig "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	basicauth "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/basic_auth/v3"
+	cors "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
+	extauthz "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	jwtauthn "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	localratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	rbac "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
+	previoushosts "github.com/envoyproxy/go-control-plane/envoy/extensions/retry/host/previous_hosts/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
 )
 
 type VhostCollection struct {
-	Vhosts      map[string]*route.VirtualHost
-	usedDomains map[string]*route.VirtualHost
+	Vhosts         map[string]*route.VirtualHost
+	usedDomains    map[string]*route.VirtualHost
+	sharedRoutes   map[string]*weightedRoute
+	authorizations map[ServiceExtAuthz]bool
+	jwtProviders   map[string]ServiceJWT
+	httpsPolicies  map[string]ServiceHTTPS
+	tlsIssuers     map[string]string
+}
+
+// weightedRoute tracks the services that claim the same domain and path, traffic is split between them by weight
+type weightedRoute struct {
+	route    *route.Route
+	labels   *ServiceLabel
+	clusters []string
+	weights  []uint32
 }
 
 func NewVhostCollection() *VhostCollection {
 	return &VhostCollection{
-		Vhosts:      make(map[string]*route.VirtualHost),
-		usedDomains: make(map[string]*route.VirtualHost),
+		Vhosts:         make(map[string]*route.VirtualHost),
+		usedDomains:    make(map[string]*route.VirtualHost),
+		sharedRoutes:   make(map[string]*weightedRoute),
+		authorizations: make(map[ServiceExtAuthz]bool),
+		jwtProviders:   make(map[string]ServiceJWT),
+		httpsPolicies:  make(map[string]ServiceHTTPS),
+		tlsIssuers:     make(map[string]string),
+	}
+}
+
+// VhostNames lists the vhosts in a stable order, exact domains come before the wildcard domains they overlap with
+// and more specific wildcards come before broader ones
+func (w VhostCollection) VhostNames() []string {
+	names := make([]string, 0, len(w.Vhosts))
+	for name := range w.Vhosts {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		iWildcard, jWildcard := IsWildcardDomain(names[i]), IsWildcardDomain(names[j])
+		if iWildcard != jWildcard {
+			return jWildcard
+		}
+
+		if iWildcard && strings.Count(names[i], ".") != strings.Count(names[j], ".") {
+			return strings.Count(names[i], ".") > strings.Count(names[j], ".")
+		}
+
+		return names[i] < names[j]
+	})
+
+	return names
+}
+
+// TLSIssuer tells where the certificate of the vhost comes from, all services of a vhost agree on this
+func (w VhostCollection) TLSIssuer(vhostName string) string {
+	if issuer := w.tlsIssuers[vhostName]; issuer != "" {
+		return issuer
+	}
+
+	return TLSIssuerACME
+}
+
+// HTTPSPolicy tells how a route behaves once its vhost has a certificate, unknown routes are always redirected
+func (w VhostCollection) HTTPSPolicy(routeName string) ServiceHTTPS {
+	if policy, exists := w.httpsPolicies[routeName]; exists {
+		return policy
+	}
+
+	return NewServiceHTTPS()
+}
+
+// JWTProviders lists the JWT configuration of routes by provider name, which is derived from the cluster name
+func (w VhostCollection) JWTProviders() map[string]ServiceJWT {
+	return w.jwtProviders
+}
+
+// JWKSClusters creates a cluster for each host that JWT providers fetch their keys from, the certificates of these
+// hosts are verified with the trusted CA bundle
+func (w VhostCollection) JWKSClusters(trustedCA string) (clusters []*cluster.Cluster, err error) {
+	names := make([]string, 0, len(w.jwtProviders))
+	for name := range w.jwtProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	created := make(map[string]bool)
+	for _, name := range names {
+		jwksURI := w.jwtProviders[name].JwksURI
+		if created[JWKSClusterName(jwksURI)] {
+			continue
+		}
+
+		c, err := JWKSCluster(jwksURI, trustedCA)
+		if err != nil {
+			return nil, err
+		}
+
+		clusters = append(clusters, c)
+		created[c.Name] = true
 	}
+
+	return clusters, nil
+}
+
+// ExternalAuthorizations lists the authorization services used by routes, each of them needs an ext_authz filter
+func (w VhostCollection) ExternalAuthorizations() []ServiceExtAuthz {
+	authorizations := make([]ServiceExtAuthz, 0, len(w.authorizations))
+	for a := range w.authorizations {
+		authorizations = append(authorizations, a)
+	}
+
+	sort.Slice(authorizations, func(i, j int) bool {
+		return ExtAuthzFilterName(authorizations[i]) < ExtAuthzFilterName(authorizations[j])
+	})
+
+	return authorizations
 }
 
 func (w VhostCollection) AddService(clusterIdentifier string, labels *ServiceLabel) (err error) {
@@ -52,16 +179,51 @@ func (w VhostCollection) AddService(clusterIdentifier string, labels *ServiceLab
 		extraDomains = append(extraDomains, extraDomain)
 	}
 
+	// Services with the same domain and path share a route, a route that receives no traffic at all is invalid
+	routeKey := createRouteKey(primaryDomain, createRouteMatch(&labels.Route))
+	sharedRoute, isShared := w.sharedRoutes[routeKey]
+	if isShared && sharedRoute.totalWeight()+labels.Route.Weight == 0 {
+		return fmt.Errorf("the route.weight of all services sharing %s%s is 0", primaryDomain, labels.Route.Path)
+	}
+
+	// The route options can't differ per cluster, so they'd be silently dropped for all but the first service
+	if isShared && !sharedRoute.hasSameOptions(labels) {
+		return fmt.Errorf("the route labels of all services sharing %s%s should be equal, except route.weight", primaryDomain, labels.Route.Path)
+	}
+
+	// A vhost is served with a single certificate
+	if issuer, exists := w.tlsIssuers[primaryDomain]; exists && issuer != labels.TLS.Issuer {
+		return fmt.Errorf("the tls.issuer %s conflicts with issuer %s of vhost %s", labels.TLS.Issuer, issuer, primaryDomain)
+	}
+
 	// Validation ended above, applying changes
 	w.Vhosts[primaryDomain] = virtualHost
+	w.tlsIssuers[primaryDomain] = labels.TLS.Issuer
 	w.usedDomains[primaryDomain] = virtualHost
 
-	// Order of routes matter, ensure that the default catch-all / comes last
-	newRoute := w.createRoute(clusterIdentifier, labels)
-	if labels.Route.PathPrefix == "/" {
-		virtualHost.Routes = append(virtualHost.Routes, newRoute)
+	if isShared {
+		sharedRoute.addCluster(clusterIdentifier, labels.Route.Weight)
 	} else {
-		virtualHost.Routes = append([]*route.Route{newRoute}, virtualHost.Routes...)
+		newRoute := w.createRoute(clusterIdentifier, labels)
+		w.httpsPolicies[newRoute.Name] = labels.Route.HTTPS
+		if labels.Route.ExtAuthz.Cluster != "" {
+			w.authorizations[labels.Route.ExtAuthz] = true
+		}
+
+		if labels.Route.JWT.enabled() {
+			w.jwtProviders[JWTProviderName(clusterIdentifier)] = labels.Route.JWT
+		}
+
+		w.sharedRoutes[routeKey] = &weightedRoute{
+			route:    newRoute,
+			labels:   labels,
+			clusters: []string{clusterIdentifier},
+			weights:  []uint32{labels.Route.Weight},
+		}
+
+		// Order of routes matter, ensure that specific routes come first and the default catch-all / comes last
+		virtualHost.Routes = append(virtualHost.Routes, newRoute)
+		sortRoutes(virtualHost.Routes)
 	}
 
 	for i := range extraDomains {
@@ -73,22 +235,481 @@ func (w VhostCollection) AddService(clusterIdentifier string, labels *ServiceLab
 }
 
 func (w VhostCollection) createRoute(clusterIdentifier string, labels *ServiceLabel) *route.Route {
-	return &route.Route{
-		Name: clusterIdentifier + "_route",
-		Match: &route.RouteMatch{
-			PathSpecifier: &route.RouteMatch_Prefix{
-				Prefix: labels.Route.PathPrefix,
-			},
+	action := &route.RouteAction{
+		ClusterSpecifier: &route.RouteAction_Cluster{
+			Cluster: clusterIdentifier,
 		},
-		Action: &route.Route_Route{
-			Route: &route.RouteAction{
-				ClusterSpecifier: &route.RouteAction_Cluster{
-					Cluster: clusterIdentifier,
+		// https://github.com/envoyproxy/envoy/issues/8517#issuecomment-540225144
+		IdleTimeout: durationpb.New(labels.Endpoint.RequestTimeout),
+		Timeout:     durationpb.New(labels.Endpoint.RequestTimeout),
+	}
+	applyRewrite(action, &labels.Route.Rewrite)
+	applyMirror(action, &labels.Route.Mirror)
+	action.RetryPolicy = createRetryPolicy(&labels.Route.Retry)
+	action.HashPolicy = createHashPolicies(&labels.Route.Affinity)
+	action.RateLimits = createRateLimits(labels.Route.RateLimit.Descriptors)
+
+	r := &route.Route{
+		Name:                    clusterIdentifier + "_route",
+		Match:                   createRouteMatch(&labels.Route),
+		Action:                  &route.Route_Route{Route: action},
+		RequestHeadersToAdd:     createHeaderValueOptions(labels.Route.HeaderMutation.RequestAdd),
+		RequestHeadersToRemove:  labels.Route.HeaderMutation.RequestRemove,
+		ResponseHeadersToAdd:    createHeaderValueOptions(labels.Route.HeaderMutation.ResponseAdd),
+		ResponseHeadersToRemove: labels.Route.HeaderMutation.ResponseRemove,
+	}
+	applyRateLimit(r, &labels.Route.RateLimit)
+	applyCors(r, &labels.Route.Cors)
+	applyIPFilter(r, labels.Route.AllowCIDRs, labels.Route.DenyCIDRs)
+	applyBasicAuth(r, &labels.Route.BasicAuth)
+	applyExtAuthz(r, &labels.Route.ExtAuthz)
+	applyJWT(r, clusterIdentifier, &labels.Route.JWT)
+
+	return r
+}
+
+// applyRateLimit enables the local rate limiter of the HTTP connection manager for this route only
+func applyRateLimit(r *route.Route, l *ServiceRateLimit) {
+	if l.Requests == 0 {
+		return
+	}
+
+	fullyEnabled := &core.RuntimeFractionalPercent{
+		RuntimeKey:   "local_rate_limit_enabled",
+		DefaultValue: &envoytype.FractionalPercent{Numerator: 100, Denominator: envoytype.FractionalPercent_HUNDRED},
+	}
+	fullyEnforced := &core.RuntimeFractionalPercent{
+		RuntimeKey:   "local_rate_limit_enforced",
+		DefaultValue: &envoytype.FractionalPercent{Numerator: 100, Denominator: envoytype.FractionalPercent_HUNDRED},
+	}
+
+	config, _ := anypb.New(&localratelimit.LocalRateLimit{
+		StatPrefix: "http_local_rate_limiter",
+		TokenBucket: &envoytype.TokenBucket{
+			MaxTokens:     l.MaxTokens(),
+			TokensPerFill: &wrapperspb.UInt32Value{Value: l.Requests},
+			FillInterval:  durationpb.New(l.Unit),
+		},
+		FilterEnabled:  fullyEnabled,
+		FilterEnforced: fullyEnforced,
+	})
+
+	setPerFilterConfig(r, LocalRateLimitFilterName, config)
+}
+
+// applyCors adds a CORS policy for this route, the CORS filter ignores routes without one
+func applyCors(r *route.Route, c *ServiceCors) {
+	if !c.enabled() {
+		return
+	}
+
+	policy := &cors.CorsPolicy{
+		AllowMethods:  strings.Join(c.AllowMethods, ","),
+		AllowHeaders:  strings.Join(c.AllowHeaders, ","),
+		ExposeHeaders: strings.Join(c.ExposeHeaders, ","),
+	}
+
+	for _, origin := range c.AllowOrigins {
+		if origin == "*" {
+			policy.AllowOriginStringMatch = append(policy.AllowOriginStringMatch, &matcher.StringMatcher{
+				MatchPattern: &matcher.StringMatcher_SafeRegex{SafeRegex: &matcher.RegexMatcher{Regex: ".*"}},
+			})
+			continue
+		}
+
+		policy.AllowOriginStringMatch = append(policy.AllowOriginStringMatch, createStringMatcher(parseRequestMatcher("origin", origin)))
+	}
+
+	if c.MaxAge > 0 {
+		policy.MaxAge = strconv.Itoa(int(c.MaxAge.Seconds()))
+	}
+
+	if c.AllowCredentials {
+		policy.AllowCredentials = &wrapperspb.BoolValue{Value: true}
+	}
+
+	config, _ := anypb.New(policy)
+	setPerFilterConfig(r, wellknown.CORS, config)
+}
+
+// applyIPFilter adds an RBAC policy that only allows requests from the allowed ranges, excluding the denied ranges
+// The client address is the downstream remote address, which is based on the trusted X-Forwarded-For hops
+func applyIPFilter(r *route.Route, allowCIDRs, denyCIDRs []string) {
+	if len(allowCIDRs) == 0 && len(denyCIDRs) == 0 {
+		return
+	}
+
+	var principals []*rbacconfig.Principal
+	if len(allowCIDRs) > 0 {
+		principals = append(principals, createRemoteIPPrincipal(allowCIDRs))
+	}
+
+	if len(denyCIDRs) > 0 {
+		principals = append(principals, &rbacconfig.Principal{
+			Identifier: &rbacconfig.Principal_NotId{NotId: createRemoteIPPrincipal(denyCIDRs)},
+		})
+	}
+
+	config, _ := anypb.New(&rbac.RBACPerRoute{Rbac: &rbac.RBAC{
+		Rules: &rbacconfig.RBAC{
+			Action: rbacconfig.RBAC_ALLOW,
+			Policies: map[string]*rbacconfig.Policy{
+				"client-address": {
+					Permissions: []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_Any{Any: true}}},
+					Principals: []*rbacconfig.Principal{{
+						Identifier: &rbacconfig.Principal_AndIds{AndIds: &rbacconfig.Principal_Set{Ids: principals}},
+					}},
 				},
-				// https://github.com/envoyproxy/envoy/issues/8517#issuecomment-540225144
-				IdleTimeout: durationpb.New(labels.Endpoint.RequestTimeout),
-				Timeout:     durationpb.New(labels.Endpoint.RequestTimeout),
 			},
 		},
+	}})
+	setPerFilterConfig(r, RBACFilterName, config)
+}
+
+func createRemoteIPPrincipal(cidrs []string) *rbacconfig.Principal {
+	var ids []*rbacconfig.Principal
+	for _, cidr := range cidrs {
+		network, _ := parseCIDR(cidr)
+		prefixLength, _ := network.Mask.Size()
+		ids = append(ids, &rbacconfig.Principal{Identifier: &rbacconfig.Principal_RemoteIp{RemoteIp: &core.CidrRange{
+			AddressPrefix: network.IP.String(),
+			PrefixLen:     &wrapperspb.UInt32Value{Value: uint32(prefixLength)},
+		}}})
+	}
+
+	return &rbacconfig.Principal{Identifier: &rbacconfig.Principal_OrIds{OrIds: &rbacconfig.Principal_Set{Ids: ids}}}
+}
+
+// applyBasicAuth enables the basic auth filter for this route, it is disabled for all other routes
+func applyBasicAuth(r *route.Route, a *ServiceBasicAuth) {
+	if a.Users == "" {
+		return
 	}
+
+	perRoute, _ := anypb.New(&basicauth.BasicAuthPerRoute{
+		Users: &core.DataSource{Specifier: &core.DataSource_InlineString{InlineString: a.Users}},
+	})
+	config, _ := anypb.New(&route.FilterConfig{Config: perRoute})
+	setPerFilterConfig(r, BasicAuthFilterName, config)
+}
+
+// applyExtAuthz enables the ext_authz filter of the authorization service for this route
+func applyExtAuthz(r *route.Route, a *ServiceExtAuthz) {
+	if a.Cluster == "" {
+		return
+	}
+
+	perRoute, _ := anypb.New(&extauthz.ExtAuthzPerRoute{
+		Override: &extauthz.ExtAuthzPerRoute_CheckSettings{CheckSettings: &extauthz.CheckSettings{}},
+	})
+	config, _ := anypb.New(&route.FilterConfig{Config: perRoute})
+	setPerFilterConfig(r, ExtAuthzFilterName(*a), config)
+}
+
+// JWTProviderName is the jwt_authn provider and requirement that belongs to the route of a cluster
+func JWTProviderName(clusterIdentifier string) string {
+	return clusterIdentifier + "_jwt"
+}
+
+// applyJWT makes the route require a valid token of the JWT provider, routes without one are not checked
+func applyJWT(r *route.Route, clusterIdentifier string, j *ServiceJWT) {
+	if !j.enabled() {
+		return
+	}
+
+	config, _ := anypb.New(&jwtauthn.PerRouteConfig{
+		RequirementSpecifier: &jwtauthn.PerRouteConfig_RequirementName{RequirementName: JWTProviderName(clusterIdentifier)},
+	})
+	setPerFilterConfig(r, JWTAuthnFilterName, config)
+}
+
+func setPerFilterConfig(r *route.Route, filterName string, config *anypb.Any) {
+	if r.TypedPerFilterConfig == nil {
+		r.TypedPerFilterConfig = make(map[string]*anypb.Any)
+	}
+
+	r.TypedPerFilterConfig[filterName] = config
+}
+
+// createHeaderValueOptions will overwrite existing headers, sorted to prevent label ordering from changing the route
+func createHeaderValueOptions(headers map[string]string) (options []*core.HeaderValueOption) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		options = append(options, &core.HeaderValueOption{
+			Header:       &core.HeaderValue{Key: name, Value: headers[name]},
+			AppendAction: core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+
+	return options
+}
+
+func applyRewrite(action *route.RouteAction, r *ServiceRewrite) {
+	action.PrefixRewrite = r.Prefix
+
+	if r.RegexPattern != "" {
+		action.RegexRewrite = &matcher.RegexMatchAndSubstitute{
+			Pattern:      &matcher.RegexMatcher{Regex: r.RegexPattern},
+			Substitution: r.RegexSubstitution,
+		}
+	}
+
+	if r.Host != "" {
+		action.HostRewriteSpecifier = &route.RouteAction_HostRewriteLiteral{HostRewriteLiteral: r.Host}
+	}
+}
+
+func applyMirror(action *route.RouteAction, m *ServiceMirror) {
+	const PercentToMillion = 10000
+	if m.Cluster == "" {
+		return
+	}
+
+	action.RequestMirrorPolicies = []*route.RouteAction_RequestMirrorPolicy{{
+		Cluster: m.Cluster,
+		RuntimeFraction: &core.RuntimeFractionalPercent{
+			DefaultValue: &envoytype.FractionalPercent{
+				Numerator:   uint32(m.Percent * PercentToMillion),
+				Denominator: envoytype.FractionalPercent_MILLION,
+			},
+		},
+	}}
+}
+
+func createRetryPolicy(r *ServiceRetry) *route.RetryPolicy {
+	const HostSelectionAttempts = 3
+	if r.Retries == 0 || len(r.On) == 0 {
+		return nil
+	}
+
+	previousHostsConfig, _ := anypb.New(&previoushosts.PreviousHostsPredicate{})
+	policy := &route.RetryPolicy{
+		RetryOn:              strings.Join(r.On, ","),
+		NumRetries:           &wrapperspb.UInt32Value{Value: r.Retries},
+		RetriableStatusCodes: r.RetriableStatusCodes,
+		// Prefer another upstream for the retry, the previous one is probably shutting down
+		RetryHostPredicate: []*route.RetryPolicy_RetryHostPredicate{{
+			Name:       "envoy.retry_host_predicates.previous_hosts",
+			ConfigType: &route.RetryPolicy_RetryHostPredicate_TypedConfig{TypedConfig: previousHostsConfig},
+		}},
+		HostSelectionRetryMaxAttempts: HostSelectionAttempts,
+	}
+
+	if r.PerTryTimeout > 0 {
+		policy.PerTryTimeout = durationpb.New(r.PerTryTimeout)
+	}
+
+	return policy
+}
+
+// createRateLimits converts descriptors into actions, the global ratelimit filter ignores routes without them
+func createRateLimits(descriptors []RateLimitDescriptor) (rateLimits []*route.RateLimit) {
+	for _, descriptor := range descriptors {
+		rateLimit := &route.RateLimit{}
+		for _, entry := range descriptor {
+			rateLimit.Actions = append(rateLimit.Actions, createRateLimitAction(entry))
+		}
+
+		rateLimits = append(rateLimits, rateLimit)
+	}
+
+	return rateLimits
+}
+
+func createRateLimitAction(entry RateLimitEntry) *route.RateLimit_Action {
+	switch entry.Type {
+	case "remote_address":
+		return &route.RateLimit_Action{ActionSpecifier: &route.RateLimit_Action_RemoteAddress_{
+			RemoteAddress: &route.RateLimit_Action_RemoteAddress{},
+		}}
+	case "destination_cluster":
+		return &route.RateLimit_Action{ActionSpecifier: &route.RateLimit_Action_DestinationCluster_{
+			DestinationCluster: &route.RateLimit_Action_DestinationCluster{},
+		}}
+	case "header":
+		return &route.RateLimit_Action{ActionSpecifier: &route.RateLimit_Action_RequestHeaders_{
+			RequestHeaders: &route.RateLimit_Action_RequestHeaders{HeaderName: entry.Name, DescriptorKey: entry.Value},
+		}}
+	default:
+		return &route.RateLimit_Action{ActionSpecifier: &route.RateLimit_Action_GenericKey_{
+			GenericKey: &route.RateLimit_Action_GenericKey{DescriptorValue: entry.Value},
+		}}
+	}
+}
+
+func createHashPolicies(a *ServiceAffinity) (policies []*route.RouteAction_HashPolicy) {
+	if a.Cookie != "" {
+		// Setting a TTL makes envoy generate the cookie, a TTL of 0 results in a session cookie
+		policies = append(policies, &route.RouteAction_HashPolicy{
+			PolicySpecifier: &route.RouteAction_HashPolicy_Cookie_{Cookie: &route.RouteAction_HashPolicy_Cookie{
+				Name: a.Cookie,
+				Ttl:  durationpb.New(a.CookieTTL),
+				Path: "/",
+			}},
+		})
+	}
+
+	if a.Header != "" {
+		policies = append(policies, &route.RouteAction_HashPolicy{
+			PolicySpecifier: &route.RouteAction_HashPolicy_Header_{Header: &route.RouteAction_HashPolicy_Header{
+				HeaderName: a.Header,
+			}},
+		})
+	}
+
+	return policies
+}
+
+func createRouteMatch(r *ServiceRoute) *route.RouteMatch {
+	match := &route.RouteMatch{}
+	switch r.PathMatch {
+	case PathMatchExact:
+		match.PathSpecifier = &route.RouteMatch_Path{Path: r.Path}
+	case PathMatchRegex:
+		match.PathSpecifier = &route.RouteMatch_SafeRegex{SafeRegex: &matcher.RegexMatcher{Regex: r.Path}}
+	case PathMatchPathSeparatedPrefix:
+		match.PathSpecifier = &route.RouteMatch_PathSeparatedPrefix{PathSeparatedPrefix: r.Path}
+	default:
+		match.PathSpecifier = &route.RouteMatch_Prefix{Prefix: r.Path}
+	}
+
+	for _, h := range sortedRequestMatchers(r.Headers) {
+		headerMatcher := &route.HeaderMatcher{Name: h.Name}
+		if h.Match == ValueMatchPresent {
+			headerMatcher.HeaderMatchSpecifier = &route.HeaderMatcher_PresentMatch{PresentMatch: true}
+		} else {
+			headerMatcher.HeaderMatchSpecifier = &route.HeaderMatcher_StringMatch{StringMatch: createStringMatcher(h)}
+		}
+
+		match.Headers = append(match.Headers, headerMatcher)
+	}
+
+	for _, q := range sortedRequestMatchers(r.QueryParameters) {
+		queryMatcher := &route.QueryParameterMatcher{Name: q.Name}
+		if q.Match == ValueMatchPresent {
+			queryMatcher.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_PresentMatch{PresentMatch: true}
+		} else {
+			queryMatcher.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_StringMatch{StringMatch: createStringMatcher(q)}
+		}
+
+		match.QueryParameters = append(match.QueryParameters, queryMatcher)
+	}
+
+	return match
+}
+
+// sortedRequestMatchers prevents label ordering from changing the route configuration
+func sortedRequestMatchers(matchers []RequestMatcher) []RequestMatcher {
+	sorted := make([]RequestMatcher, len(matchers))
+	copy(sorted, matchers)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	return sorted
+}
+
+func createStringMatcher(m RequestMatcher) *matcher.StringMatcher {
+	switch m.Match {
+	case ValueMatchPrefix:
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Prefix{Prefix: m.Value}}
+	case ValueMatchRegex:
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_SafeRegex{SafeRegex: &matcher.RegexMatcher{Regex: m.Value}}}
+	default:
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: m.Value}}
+	}
+}
+
+// sortRoutes orders routes from most to least specific, envoy will use the first route that matches a request
+func sortRoutes(routes []*route.Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i].GetMatch(), routes[j].GetMatch()
+		if pathMatchRank(a) != pathMatchRank(b) {
+			return pathMatchRank(a) < pathMatchRank(b)
+		}
+
+		if len(matchedPath(a)) != len(matchedPath(b)) {
+			return len(matchedPath(a)) > len(matchedPath(b))
+		}
+
+		return len(a.GetHeaders())+len(a.GetQueryParameters()) > len(b.GetHeaders())+len(b.GetQueryParameters())
+	})
+}
+
+func pathMatchRank(m *route.RouteMatch) int {
+	switch m.GetPathSpecifier().(type) {
+	case *route.RouteMatch_Path:
+		return 0
+	case *route.RouteMatch_SafeRegex:
+		return 1
+	default:
+		return 2 // prefixes are ranked by their length
+	}
+}
+
+func matchedPath(m *route.RouteMatch) string {
+	switch p := m.GetPathSpecifier().(type) {
+	case *route.RouteMatch_Path:
+		return p.Path
+	case *route.RouteMatch_SafeRegex:
+		return p.SafeRegex.GetRegex()
+	case *route.RouteMatch_PathSeparatedPrefix:
+		return p.PathSeparatedPrefix
+	case *route.RouteMatch_Prefix:
+		return p.Prefix
+	}
+
+	return ""
+}
+
+// createRouteKey identifies routes within a vhost by their match, protobuf is deterministic enough for this purpose
+func createRouteKey(primaryDomain string, match *route.RouteMatch) string {
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(match)
+
+	return primaryDomain + string(b)
+}
+
+func (r *weightedRoute) totalWeight() (total uint32) {
+	for _, weight := range r.weights {
+		total += weight
+	}
+
+	return total
+}
+
+// hasSameOptions tells if the labels configure the route exactly like the labels of the first service did
+func (r *weightedRoute) hasSameOptions(labels *ServiceLabel) bool {
+	return r.labels.Endpoint.RequestTimeout == labels.Endpoint.RequestTimeout &&
+		reflect.DeepEqual(routeOptions(&r.labels.Route), routeOptions(&labels.Route))
+}
+
+// routeOptions strips the properties of a route that services sharing it are allowed to differ in
+// Matchers are sorted, as their order follows the labels of the service and those have no order
+func routeOptions(r *ServiceRoute) ServiceRoute {
+	options := *r
+	options.ExtraDomains = nil
+	options.Weight = 0
+	options.Headers = sortedRequestMatchers(r.Headers)
+	options.QueryParameters = sortedRequestMatchers(r.QueryParameters)
+
+	return options
+}
+
+// addCluster will convert the route action into weighted clusters, the route options are equal for all services
+func (r *weightedRoute) addCluster(clusterIdentifier string, weight uint32) {
+	r.clusters = append(r.clusters, clusterIdentifier)
+	r.weights = append(r.weights, weight)
+
+	weighted := &route.WeightedCluster{}
+	for i := range r.clusters {
+		weighted.Clusters = append(weighted.Clusters, &route.WeightedCluster_ClusterWeight{
+			Name:   r.clusters[i],
+			Weight: &wrapperspb.UInt32Value{Value: r.weights[i]},
+		})
+	}
+
+	r.route.GetRoute().ClusterSpecifier = &route.RouteAction_WeightedClusters{WeightedClusters: weighted}
 }
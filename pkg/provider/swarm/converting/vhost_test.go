@@ -1,9 +1,17 @@
 package converting
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	basicauth "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/basic_auth/v3"
+	cors "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
+	jwtauthn "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	localratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	rbac "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
 
 	"gotest.tools/assert"
 )
@@ -49,14 +57,14 @@ func TestCombinedVhostDomainsIsTheSumOfAllLabels(t *testing.T) {
 		Route: ServiceRoute{
 			Domain:       "example.com",
 			ExtraDomains: []string{"www.example.com"},
-			PathPrefix:   "/",
+			Path:         "/",
 		},
 	}
 	bLabels := ServiceLabel{
 		Route: ServiceRoute{
 			Domain:       "example.com",
 			ExtraDomains: []string{"www.example.com", "api.example.com"},
-			PathPrefix:   "/api",
+			Path:         "/api",
 		},
 	}
 
@@ -72,14 +80,14 @@ func TestRoutesAreAddedPerService(t *testing.T) {
 		Route: ServiceRoute{
 			Domain:       "example.com",
 			ExtraDomains: []string{},
-			PathPrefix:   "/",
+			Path:         "/",
 		},
 	}
 	bLabels := ServiceLabel{
 		Route: ServiceRoute{
 			Domain:       "example.com",
 			ExtraDomains: []string{},
-			PathPrefix:   "/api",
+			Path:         "/api",
 		},
 	}
 
@@ -96,14 +104,14 @@ func TestDefaultRouteComesLast(t *testing.T) {
 		Route: ServiceRoute{
 			Domain:       "example.com",
 			ExtraDomains: []string{},
-			PathPrefix:   "/",
+			Path:         "/",
 		},
 	}
 	bLabels := ServiceLabel{
 		Route: ServiceRoute{
 			Domain:       "example.com",
 			ExtraDomains: []string{},
-			PathPrefix:   "/api",
+			Path:         "/api",
 		},
 	}
 
@@ -115,6 +123,36 @@ func TestDefaultRouteComesLast(t *testing.T) {
 	assert.Equal(t, routes[1].Match.PathSpecifier.(*route.RouteMatch_Prefix).Prefix, "/")
 }
 
+func TestExactDomainsComeBeforeWildcardDomains(t *testing.T) {
+	collection := NewVhostCollection()
+	for _, domain := range []string{"*.example.com", "acme.customers.example.com", "*.customers.example.com", "example.com"} {
+		labels := ServiceLabel{Route: ServiceRoute{Domain: domain, Path: "/"}}
+		assert.NilError(t, collection.AddService(strings.ReplaceAll(domain, "*", "wildcard"), &labels))
+	}
+
+	assert.DeepEqual(t, collection.VhostNames(), []string{
+		"acme.customers.example.com",
+		"example.com",
+		"*.customers.example.com",
+		"*.example.com",
+	})
+}
+
+func TestServicesOfAVhostShouldAgreeOnTheTLSIssuer(t *testing.T) {
+	collection := NewVhostCollection()
+	frontend := NewServiceLabel()
+	frontend.Route.Domain = "example.com"
+	api := NewServiceLabel()
+	api.Route.Domain = "example.com"
+	api.Route.Path = "/api"
+	api.TLS.Issuer = TLSIssuerManual
+
+	assert.NilError(t, collection.AddService("frontend", &frontend))
+	assert.Error(t, collection.AddService("api", &api), "the tls.issuer manual conflicts with issuer acme of vhost example.com")
+	assert.Equal(t, collection.TLSIssuer("example.com"), TLSIssuerACME)
+	assert.Equal(t, len(collection.Vhosts["example.com"].Routes), 1)
+}
+
 func TestVhostDomainShouldBeUnique(t *testing.T) {
 	collection := NewVhostCollection()
 	firstService := ServiceLabel{
@@ -155,3 +193,511 @@ func TestVhostCollectionAddServiceIsNotCorruptedOnOnError(t *testing.T) {
 	assert.Equal(t, len(collection.Vhosts["example.com"].GetDomains()), 1)
 	assert.Check(t, collection.Vhosts["example.com"].Validate() == nil)
 }
+
+func TestRouteMatchFollowsPathMatch(t *testing.T) {
+	collection := NewVhostCollection()
+	exactLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain:    "example.com",
+			Path:      "/health",
+			PathMatch: PathMatchExact,
+		},
+	}
+	separatedLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain:    "example.com",
+			Path:      "/api",
+			PathMatch: PathMatchPathSeparatedPrefix,
+		},
+	}
+	regexLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain:    "example.com",
+			Path:      "/v[0-9]+/.*",
+			PathMatch: PathMatchRegex,
+		},
+	}
+
+	_ = collection.AddService("health", &exactLabels)
+	_ = collection.AddService("api", &separatedLabels)
+	_ = collection.AddService("versioned", &regexLabels)
+	routes := collection.Vhosts["example.com"].GetRoutes()
+
+	assert.Equal(t, routes[0].Match.PathSpecifier.(*route.RouteMatch_Path).Path, "/health")
+	assert.Equal(t, routes[1].Match.PathSpecifier.(*route.RouteMatch_SafeRegex).SafeRegex.Regex, "/v[0-9]+/.*")
+	assert.Equal(t, routes[2].Match.PathSpecifier.(*route.RouteMatch_PathSeparatedPrefix).PathSeparatedPrefix, "/api")
+}
+
+func TestExactRootPathIsNotTreatedAsCatchAll(t *testing.T) {
+	collection := NewVhostCollection()
+	fLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain:    "example.com",
+			Path:      "/",
+			PathMatch: PathMatchPrefix,
+		},
+	}
+	rootLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain:    "example.com",
+			Path:      "/",
+			PathMatch: PathMatchExact,
+		},
+	}
+
+	_ = collection.AddService("frontend", &fLabels)
+	_ = collection.AddService("landing", &rootLabels)
+	routes := collection.Vhosts["example.com"].GetRoutes()
+
+	assert.Equal(t, routes[0].Name, "landing_route")
+	assert.Equal(t, routes[1].Name, "frontend_route")
+}
+
+func TestRouteActionContainsRewrites(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain: "example.com",
+			Path:   "/billing",
+			Rewrite: ServiceRewrite{
+				Prefix: "/",
+				Host:   "billing.internal",
+			},
+		},
+	}
+
+	_ = collection.AddService("billing", &labels)
+	action := collection.Vhosts["example.com"].GetRoutes()[0].GetRoute()
+
+	assert.Equal(t, action.PrefixRewrite, "/")
+	assert.Equal(t, action.GetHostRewriteLiteral(), "billing.internal")
+	assert.Check(t, action.RegexRewrite == nil)
+}
+
+func TestServicesWithSameDomainAndPathShareWeightedRoute(t *testing.T) {
+	collection := NewVhostCollection()
+	blueLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain: "example.com",
+			Path:   "/",
+			Weight: 90,
+		},
+	}
+	greenLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain: "example.com",
+			Path:   "/",
+			Weight: 10,
+		},
+	}
+
+	assert.NilError(t, collection.AddService("blue", &blueLabels))
+	assert.NilError(t, collection.AddService("green", &greenLabels))
+	routes := collection.Vhosts["example.com"].GetRoutes()
+
+	assert.Equal(t, len(routes), 1)
+	clusters := routes[0].GetRoute().GetWeightedClusters().GetClusters()
+	assert.Equal(t, len(clusters), 2)
+	assert.Equal(t, clusters[0].Name, "blue")
+	assert.Equal(t, clusters[0].Weight.Value, uint32(90))
+	assert.Equal(t, clusters[1].Name, "green")
+	assert.Equal(t, clusters[1].Weight.Value, uint32(10))
+}
+
+func TestServicesSharingARouteShouldHaveEqualRouteOptions(t *testing.T) {
+	collection := NewVhostCollection()
+	blueLabels := NewServiceLabel()
+	blueLabels.Route.Domain = "example.com"
+	greenLabels := NewServiceLabel()
+	greenLabels.Route.Domain = "example.com"
+	greenLabels.Route.ExtraDomains = []string{"www.example.com"}
+	greenLabels.Route.Weight = 5
+	greenLabels.Route.Rewrite.Prefix = "/v2"
+
+	assert.NilError(t, collection.AddService("blue", &blueLabels))
+	assert.Error(t, collection.AddService("green", &greenLabels), "the route labels of all services sharing example.com/ should be equal, except route.weight")
+	assert.Equal(t, collection.Vhosts["example.com"].GetRoutes()[0].GetRoute().GetCluster(), "blue")
+
+	greenLabels.Route.Rewrite.Prefix = blueLabels.Route.Rewrite.Prefix
+	greenLabels.Endpoint.RequestTimeout = time.Minute
+	assert.Error(t, collection.AddService("green", &greenLabels), "the route labels of all services sharing example.com/ should be equal, except route.weight")
+
+	greenLabels.Endpoint.RequestTimeout = blueLabels.Endpoint.RequestTimeout
+	assert.NilError(t, collection.AddService("green", &greenLabels))
+}
+
+func TestServicesSharingARouteIgnoreTheOrderOfMatchers(t *testing.T) {
+	collection := NewVhostCollection()
+	blueLabels := NewServiceLabel()
+	blueLabels.Route.Domain = "example.com"
+	blueLabels.Route.Headers = []RequestMatcher{
+		{Name: "x-tenant", Match: ValueMatchExact, Value: "beta"},
+		{Name: "x-canary", Match: ValueMatchPresent},
+	}
+	blueLabels.Route.QueryParameters = []RequestMatcher{
+		{Name: "preview", Match: ValueMatchPresent},
+		{Name: "lang", Match: ValueMatchPrefix, Value: "en"},
+	}
+	greenLabels := NewServiceLabel()
+	greenLabels.Route.Domain = "example.com"
+	greenLabels.Route.Headers = []RequestMatcher{blueLabels.Route.Headers[1], blueLabels.Route.Headers[0]}
+	greenLabels.Route.QueryParameters = []RequestMatcher{blueLabels.Route.QueryParameters[1], blueLabels.Route.QueryParameters[0]}
+
+	assert.NilError(t, collection.AddService("blue", &blueLabels))
+	assert.NilError(t, collection.AddService("green", &greenLabels))
+
+	routes := collection.Vhosts["example.com"].GetRoutes()
+	assert.Equal(t, len(routes), 1)
+	assert.Equal(t, len(routes[0].GetRoute().GetWeightedClusters().Clusters), 2)
+}
+
+// A protected service would lose its protection for the traffic that is weighted towards an unprotected service
+func TestProtectedServicesCantShareRouteWithUnprotectedServices(t *testing.T) {
+	testcases := map[string]func(labels *ServiceLabel){
+		"allow-cidrs": func(labels *ServiceLabel) { labels.Route.AllowCIDRs = []string{"10.0.0.0/8"} },
+		"deny-cidrs":  func(labels *ServiceLabel) { labels.Route.DenyCIDRs = []string{"10.0.0.1"} },
+		"basic-auth": func(labels *ServiceLabel) {
+			labels.Route.BasicAuth = ServiceBasicAuth{Config: "admins", Users: "admin:{SHA}0DPiKuNIrrVmD8IUCuw1hQxNqZc="}
+		},
+		"ext-authz": func(labels *ServiceLabel) {
+			labels.Route.ExtAuthz = ServiceExtAuthz{Cluster: "authorizer", Mode: ExtAuthzModeGRPC}
+		},
+		"jwt": func(labels *ServiceLabel) {
+			labels.Route.JWT = ServiceJWT{Issuer: "https://auth.example.com/", JwksURI: "https://auth.example.com/jwks.json"}
+		},
+	}
+
+	for name, protect := range testcases {
+		t.Run(name, func(t *testing.T) {
+			collection := NewVhostCollection()
+			openLabels := NewServiceLabel()
+			openLabels.Route.Domain = "example.com"
+			protectedLabels := NewServiceLabel()
+			protectedLabels.Route.Domain = "example.com"
+			protect(&protectedLabels)
+
+			assert.NilError(t, collection.AddService("open", &openLabels))
+			assert.Error(t, collection.AddService("protected", &protectedLabels), "the route labels of all services sharing example.com/ should be equal, except route.weight")
+			assert.Equal(t, collection.Vhosts["example.com"].GetRoutes()[0].GetRoute().GetCluster(), "open")
+		})
+	}
+}
+
+func TestSingleServiceRouteIsNotWeighted(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain: "example.com",
+			Path:   "/",
+			Weight: 50,
+		},
+	}
+
+	_ = collection.AddService("frontend", &labels)
+	action := collection.Vhosts["example.com"].GetRoutes()[0].GetRoute()
+
+	assert.Equal(t, action.GetCluster(), "frontend")
+	assert.Check(t, action.GetWeightedClusters() == nil)
+}
+
+func TestSharedRouteRequiresWeight(t *testing.T) {
+	collection := NewVhostCollection()
+	blueLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain: "example.com",
+			Path:   "/api",
+			Weight: 0,
+		},
+	}
+	greenLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain: "example.com",
+			Path:   "/api",
+			Weight: 0,
+		},
+	}
+
+	assert.NilError(t, collection.AddService("blue", &blueLabels))
+	assert.Error(t, collection.AddService("green", &greenLabels), "the route.weight of all services sharing example.com/api is 0")
+	assert.Equal(t, collection.Vhosts["example.com"].GetRoutes()[0].GetRoute().GetCluster(), "blue")
+}
+
+func TestRoutesWithHeadersComeBeforePlainPrefixRoutes(t *testing.T) {
+	collection := NewVhostCollection()
+	stableLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain: "example.com",
+			Path:   "/",
+		},
+	}
+	betaLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain:  "example.com",
+			Path:    "/",
+			Headers: []RequestMatcher{{Name: "X-Tenant", Match: ValueMatchExact, Value: "beta"}},
+		},
+	}
+	previewLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain:          "example.com",
+			Path:            "/",
+			QueryParameters: []RequestMatcher{{Name: "preview", Match: ValueMatchPresent}},
+		},
+	}
+
+	_ = collection.AddService("stable", &stableLabels)
+	_ = collection.AddService("beta", &betaLabels)
+	_ = collection.AddService("preview", &previewLabels)
+	routes := collection.Vhosts["example.com"].GetRoutes()
+
+	assert.Equal(t, len(routes), 3)
+	assert.Equal(t, routes[0].Name, "beta_route")
+	assert.Equal(t, routes[0].Match.Headers[0].GetStringMatch().GetExact(), "beta")
+	assert.Equal(t, routes[1].Name, "preview_route")
+	assert.Equal(t, routes[1].Match.QueryParameters[0].GetPresentMatch(), true)
+	assert.Equal(t, routes[2].Name, "stable_route")
+}
+
+func TestLongerPrefixRoutesComeFirst(t *testing.T) {
+	collection := NewVhostCollection()
+	apiLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain: "example.com",
+			Path:   "/api",
+		},
+	}
+	adminLabels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain: "example.com",
+			Path:   "/api/admin",
+		},
+	}
+
+	_ = collection.AddService("api", &apiLabels)
+	_ = collection.AddService("admin", &adminLabels)
+	routes := collection.Vhosts["example.com"].GetRoutes()
+
+	assert.Equal(t, routes[0].Name, "admin_route")
+	assert.Equal(t, routes[1].Name, "api_route")
+}
+
+func TestRouteActionContainsMirrorPolicy(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := ServiceLabel{
+		Route: ServiceRoute{
+			Domain: "example.com",
+			Path:   "/",
+			Mirror: ServiceMirror{Cluster: "api-next", Percent: 12.5},
+		},
+	}
+
+	_ = collection.AddService("api", &labels)
+	policies := collection.Vhosts["example.com"].GetRoutes()[0].GetRoute().GetRequestMirrorPolicies()
+
+	assert.Equal(t, len(policies), 1)
+	assert.Equal(t, policies[0].Cluster, "api-next")
+	assert.Equal(t, policies[0].RuntimeFraction.DefaultValue.Numerator, uint32(125000))
+}
+
+func TestRouteActionContainsRetryPolicy(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := NewServiceLabel()
+	labels.Route.Domain = "example.com"
+
+	_ = collection.AddService("frontend", &labels)
+	policy := collection.Vhosts["example.com"].GetRoutes()[0].GetRoute().GetRetryPolicy()
+
+	assert.Equal(t, policy.RetryOn, "connect-failure,refused-stream")
+	assert.Equal(t, policy.NumRetries.Value, uint32(2))
+	assert.Equal(t, policy.RetryHostPredicate[0].Name, "envoy.retry_host_predicates.previous_hosts")
+	assert.Check(t, policy.PerTryTimeout == nil)
+	assert.NilError(t, collection.Vhosts["example.com"].Validate())
+}
+
+func TestRouteActionWithoutRetries(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := NewServiceLabel()
+	labels.Route.Domain = "example.com"
+	labels.Route.Retry.Retries = 0
+
+	_ = collection.AddService("frontend", &labels)
+
+	assert.Check(t, collection.Vhosts["example.com"].GetRoutes()[0].GetRoute().GetRetryPolicy() == nil)
+}
+
+func TestRouteActionContainsStickyCookieHashPolicy(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := NewServiceLabel()
+	labels.Route.Domain = "example.com"
+	labels.Route.Affinity.Cookie = "backend"
+
+	_ = collection.AddService("legacy", &labels)
+	policies := collection.Vhosts["example.com"].GetRoutes()[0].GetRoute().GetHashPolicy()
+
+	assert.Equal(t, len(policies), 1)
+	assert.Equal(t, policies[0].GetCookie().Name, "backend")
+	assert.Equal(t, policies[0].GetCookie().Ttl.AsDuration(), time.Duration(0))
+	assert.Equal(t, policies[0].GetCookie().Path, "/")
+	assert.NilError(t, collection.Vhosts["example.com"].Validate())
+}
+
+func TestRouteEnablesLocalRateLimit(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := NewServiceLabel()
+	labels.Route.Domain = "example.com"
+	labels.Route.RateLimit.Requests = 10
+	labels.Route.RateLimit.Unit = time.Minute
+
+	_ = collection.AddService("frontend", &labels)
+	config := collection.Vhosts["example.com"].GetRoutes()[0].GetTypedPerFilterConfig()[LocalRateLimitFilterName]
+
+	limit := &localratelimit.LocalRateLimit{}
+	assert.NilError(t, config.UnmarshalTo(limit))
+	assert.Equal(t, limit.TokenBucket.MaxTokens, uint32(10))
+	assert.Equal(t, limit.TokenBucket.FillInterval.AsDuration(), time.Minute)
+	assert.Equal(t, limit.FilterEnforced.DefaultValue.Numerator, uint32(100))
+	assert.NilError(t, collection.Vhosts["example.com"].Validate())
+}
+
+func TestRouteWithoutRateLimit(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := NewServiceLabel()
+	labels.Route.Domain = "example.com"
+
+	_ = collection.AddService("frontend", &labels)
+
+	assert.Equal(t, len(collection.Vhosts["example.com"].GetRoutes()[0].GetTypedPerFilterConfig()), 0)
+}
+
+func TestRouteActionContainsRateLimitActions(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := NewServiceLabel()
+	labels.Route.Domain = "example.com"
+	labels.Route.RateLimit.Descriptors = []RateLimitDescriptor{
+		{{Type: "remote_address"}},
+		{{Type: "generic_key", Value: "api"}, {Type: "header", Name: "x-api-key", Value: "api_key"}},
+	}
+
+	_ = collection.AddService("frontend", &labels)
+	rateLimits := collection.Vhosts["example.com"].GetRoutes()[0].GetRoute().GetRateLimits()
+
+	assert.Equal(t, len(rateLimits), 2)
+	assert.Check(t, rateLimits[0].Actions[0].GetRemoteAddress() != nil)
+	assert.Equal(t, rateLimits[1].Actions[0].GetGenericKey().DescriptorValue, "api")
+	assert.Equal(t, rateLimits[1].Actions[1].GetRequestHeaders().HeaderName, "x-api-key")
+	assert.NilError(t, collection.Vhosts["example.com"].Validate())
+}
+
+func TestRouteContainsCorsPolicy(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := NewServiceLabel()
+	labels.Route.Domain = "api.example.com"
+	labels.Route.Cors.AllowOrigins = []string{"https://app.example.com", "*"}
+	labels.Route.Cors.AllowMethods = []string{"GET", "POST"}
+	labels.Route.Cors.MaxAge = time.Hour
+
+	_ = collection.AddService("api", &labels)
+	config := collection.Vhosts["api.example.com"].GetRoutes()[0].GetTypedPerFilterConfig()[wellknown.CORS]
+
+	policy := &cors.CorsPolicy{}
+	assert.NilError(t, config.UnmarshalTo(policy))
+	assert.Equal(t, policy.AllowOriginStringMatch[0].GetExact(), "https://app.example.com")
+	assert.Equal(t, policy.AllowOriginStringMatch[1].GetSafeRegex().Regex, ".*")
+	assert.Equal(t, policy.AllowMethods, "GET,POST")
+	assert.Equal(t, policy.MaxAge, "3600")
+	assert.Check(t, policy.AllowCredentials == nil)
+	assert.NilError(t, collection.Vhosts["api.example.com"].Validate())
+}
+
+func TestRouteContainsIPFilter(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := NewServiceLabel()
+	labels.Route.Domain = "admin.example.com"
+	labels.Route.AllowCIDRs = []string{"10.0.0.0/8", "192.168.1.10"}
+	labels.Route.DenyCIDRs = []string{"10.0.13.0/24"}
+
+	_ = collection.AddService("admin", &labels)
+	config := collection.Vhosts["admin.example.com"].GetRoutes()[0].GetTypedPerFilterConfig()[RBACFilterName]
+
+	perRoute := &rbac.RBACPerRoute{}
+	assert.NilError(t, config.UnmarshalTo(perRoute))
+	principals := perRoute.Rbac.Rules.Policies["client-address"].Principals[0].GetAndIds().Ids
+	allowed := principals[0].GetOrIds().Ids
+	assert.Equal(t, allowed[1].GetRemoteIp().AddressPrefix, "192.168.1.10")
+	assert.Equal(t, allowed[1].GetRemoteIp().PrefixLen.Value, uint32(32))
+	assert.Equal(t, principals[1].GetNotId().GetOrIds().Ids[0].GetRemoteIp().AddressPrefix, "10.0.13.0")
+	assert.NilError(t, collection.Vhosts["admin.example.com"].Validate())
+}
+
+func TestRouteEnablesBasicAuth(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := NewServiceLabel()
+	labels.Route.Domain = "staging.example.com"
+	labels.Route.BasicAuth = ServiceBasicAuth{Config: "staging-users", Users: "admin:{SHA}0DPiKuNIrrVmD8IUCuw1hQxNqZc="}
+
+	_ = collection.AddService("staging", &labels)
+	config := collection.Vhosts["staging.example.com"].GetRoutes()[0].GetTypedPerFilterConfig()[BasicAuthFilterName]
+
+	filterConfig := &route.FilterConfig{}
+	assert.NilError(t, config.UnmarshalTo(filterConfig))
+	perRoute := &basicauth.BasicAuthPerRoute{}
+	assert.NilError(t, filterConfig.Config.UnmarshalTo(perRoute))
+	assert.Equal(t, perRoute.Users.GetInlineString(), "admin:{SHA}0DPiKuNIrrVmD8IUCuw1hQxNqZc=")
+	assert.NilError(t, collection.Vhosts["staging.example.com"].Validate())
+}
+
+func TestRouteEnablesExtAuthz(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := NewServiceLabel()
+	labels.Route.Domain = "app.example.com"
+	labels.Route.ExtAuthz.Cluster = "sso-gateway"
+
+	_ = collection.AddService("app", &labels)
+	configs := collection.Vhosts["app.example.com"].GetRoutes()[0].GetTypedPerFilterConfig()
+
+	assert.DeepEqual(t, collection.ExternalAuthorizations(), []ServiceExtAuthz{{Cluster: "sso-gateway", Mode: ExtAuthzModeHTTP}})
+	assert.Check(t, configs["envoy.filters.http.ext_authz.http.sso-gateway"] != nil)
+	assert.NilError(t, collection.Vhosts["app.example.com"].Validate())
+}
+
+func TestRouteRequiresJWT(t *testing.T) {
+	collection := NewVhostCollection()
+	api := NewServiceLabel()
+	api.Route.Domain = "api.example.com"
+	api.Route.JWT = ServiceJWT{Issuer: "https://auth.example.com/", JwksURI: "https://auth.example.com/jwks.json"}
+	billing := NewServiceLabel()
+	billing.Route.Domain = "billing.example.com"
+	billing.Route.JWT = ServiceJWT{Issuer: "https://auth.example.com/", JwksURI: "https://auth.example.com/jwks.json"}
+
+	_ = collection.AddService("api", &api)
+	_ = collection.AddService("billing", &billing)
+	config := collection.Vhosts["api.example.com"].GetRoutes()[0].GetTypedPerFilterConfig()[JWTAuthnFilterName]
+
+	perRoute := &jwtauthn.PerRouteConfig{}
+	assert.NilError(t, config.UnmarshalTo(perRoute))
+	assert.Equal(t, perRoute.GetRequirementName(), "api_jwt")
+	assert.Equal(t, len(collection.JWTProviders()), 2)
+	jwksClusters, err := collection.JWKSClusters(DefaultTrustedCA)
+	assert.NilError(t, err)
+	assert.Equal(t, len(jwksClusters), 1)
+}
+
+func TestRouteContainsHeaderMutations(t *testing.T) {
+	collection := NewVhostCollection()
+	labels := NewServiceLabel()
+	labels.Route.Domain = "example.com"
+	labels.Route.HeaderMutation = ServiceHeaderMutation{
+		RequestAdd:     map[string]string{"x-edge-host": "%HOSTNAME%"},
+		ResponseAdd:    map[string]string{"x-frame-options": "DENY", "content-security-policy": "default-src 'self'"},
+		ResponseRemove: []string{"x-powered-by"},
+	}
+
+	_ = collection.AddService("frontend", &labels)
+	r := collection.Vhosts["example.com"].GetRoutes()[0]
+
+	assert.Equal(t, r.RequestHeadersToAdd[0].Header.Key, "x-edge-host")
+	assert.Equal(t, r.ResponseHeadersToAdd[0].Header.Key, "content-security-policy")
+	assert.Equal(t, r.ResponseHeadersToAdd[1].Header.Value, "DENY")
+	assert.DeepEqual(t, r.ResponseHeadersToRemove, []string{"x-powered-by"})
+	assert.NilError(t, collection.Vhosts["example.com"].Validate())
+}
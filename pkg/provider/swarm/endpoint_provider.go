@@ -0,0 +1,65 @@
+package swarm
+
+import (
+	"context"
+
+	swarmtypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	docker "github.com/docker/docker/client"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/client"
+	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/provider/swarm/converting"
+)
+
+// EndpointProvider will convert the running tasks of swarm services into endpoints for Envoy (EDS)
+type EndpointProvider struct {
+	dockerClient docker.APIClient
+}
+
+func NewEndpointProvider() *EndpointProvider {
+	return &EndpointProvider{dockerClient: client.NewDockerClient()}
+}
+
+// ProvideEndpoints creates a load assignment for each cluster, pointing to the ingress IP of every running task
+func (e *EndpointProvider) ProvideEndpoints(ctx context.Context, ingressNetworkID string, routables []routableCluster) (endpoints []types.Resource, err error) {
+	tasks, err := e.runningTasksByService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range routables {
+		loadAssignment, err := converting.TasksToLoadAssignment(r.cluster.Name, tasks[r.service.ID], ingressNetworkID, r.labels)
+		if err != nil {
+			// Envoy keeps a cluster warming until it has a load assignment, an empty one keeps the other clusters going
+			r.logger.Warnf("skipped generating EDS for service because %s", err.Error())
+			loadAssignment = &endpoint.ClusterLoadAssignment{ClusterName: r.cluster.Name}
+		}
+
+		endpoints = append(endpoints, loadAssignment)
+	}
+
+	return endpoints, nil
+}
+
+func (e *EndpointProvider) runningTasksByService(ctx context.Context) (map[string][]swarm.Task, error) {
+	tasks, err := e.dockerClient.TaskList(ctx, swarmtypes.TaskListOptions{
+		Filters: filters.NewArgs(filters.Arg("desired-state", string(swarm.TaskStateRunning))),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A task that should be running can still be starting or shutting down, those won't receive traffic yet
+	byService := make(map[string][]swarm.Task)
+	for i := range tasks {
+		if tasks[i].Status.State != swarm.TaskStateRunning {
+			continue
+		}
+
+		byService[tasks[i].ServiceID] = append(byService[tasks[i].ServiceID], tasks[i])
+	}
+
+	return byService, nil
+}
@@ -1,17 +1,22 @@
 package swarm
 
 import (
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/acme"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/provider"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/provider/swarm/converting"
+	"google.golang.org/protobuf/proto"
 )
 
 type ListenerProvider struct {
-	sdsProvider     provider.SDS
-	acmeIntegration *acme.Integration
+	sdsProvider      provider.SDS
+	acmeIntegration  *acme.Integration
+	rateLimitDomain  string
+	rateLimitCluster string
+	trustedProxyHops uint32
 }
 
 func NewListenerProvider(sdsProvider provider.SDS, acmeIntegration *acme.Integration) *ListenerProvider {
@@ -21,6 +26,21 @@ func NewListenerProvider(sdsProvider provider.SDS, acmeIntegration *acme.Integra
 	}
 }
 
+// WithRateLimitService makes the listeners use a global ratelimit service for routes with ratelimit descriptors
+func (l *ListenerProvider) WithRateLimitService(domain, clusterName string) *ListenerProvider {
+	l.rateLimitDomain = domain
+	l.rateLimitCluster = clusterName
+
+	return l
+}
+
+// WithTrustedProxyHops configures how many proxies in front of envoy add themselves to the X-Forwarded-For header
+func (l *ListenerProvider) WithTrustedProxyHops(hops uint32) *ListenerProvider {
+	l.trustedProxyHops = hops
+
+	return l
+}
+
 // ProvideListeners breaks down a vhost collection into listener configs it will return a collection of max 2 listeners
 // for port 80 and 443.
 func (l *ListenerProvider) ProvideListeners(collection *converting.VhostCollection) ([]types.Resource, error) {
@@ -40,69 +60,155 @@ func (l *ListenerProvider) ProvideListeners(collection *converting.VhostCollecti
 // This assures we serve the correct certificate even before we know what the request speaks (we assume HTTP)
 func (l *ListenerProvider) createListenersFromVhosts(collection *converting.VhostCollection) (http, https *listener.Listener) {
 	// Every vhost that doesn't have a certificate will end up in our generic HTTP catch-all filter
-	httpFilter := converting.NewFilterChainBuilder("httpFilter")
+	httpFilter := l.newFilterChainBuilder("httpFilter", collection)
 
 	// Each filter is added to a listener, a listener will instruct envoy to "listen" on a port
 	httpBuilder := converting.NewListenerBuilder("http_listener")
 	httpsBuilder := converting.NewListenerBuilder("https_listener").EnableTLS()
 
-	for i := range collection.Vhosts {
-		vhost := collection.Vhosts[i]
+	var challengeDomains []string
+	for _, name := range collection.VhostNames() {
+		vhost := collection.Vhosts[name]
+		issuer := collection.TLSIssuer(name)
 		hasValidCertificate := false
-		if l.sdsProvider != nil {
+		if l.sdsProvider != nil && issuer != converting.TLSIssuerNone {
 			hasValidCertificate = l.sdsProvider.HasValidCertificate(vhost)
 		}
 
-		// handle LetsEncrypt first because it might mutate the vhost config
-		if l.acmeIntegration != nil {
+		// handle LetsEncrypt first because it might mutate the vhost config, manual certificates are only read from storage
+		if l.acmeIntegration != nil && issuer != converting.TLSIssuerNone && issuer != converting.TLSIssuerManual {
 			// this covers two use cases: new certificates (hasValidCertificate) and schedules renewals (IsScheduledForIssuing)
 			if !hasValidCertificate || l.acmeIntegration.IsScheduledForIssuing(vhost) {
-				vhost = l.acmeIntegration.PrepareVhostForIssuing(vhost)
+				// the domains are collected upfront, as preparing adds the domains with a port value
+				domains := vhost.GetDomains()
+
+				var prepared bool
+				if vhost, prepared = l.acmeIntegration.PrepareVhostForIssuing(vhost, issuer); prepared {
+					challengeDomains = append(challengeDomains, domains...)
+				}
 			}
 
 			if hasValidCertificate {
-				l.acmeIntegration.EnableAutoRenewal(vhost)
+				l.acmeIntegration.EnableAutoRenewal(vhost, issuer)
 			}
 		}
 
 		if hasValidCertificate {
-			httpsFilter := l.createFilterChainWithTLS(vhost)
-			httpsFilter.ForVhost(vhost)
+			httpsFilter := l.createFilterChainWithTLS(vhost, collection)
+			httpsFilter.ForVhost(createNewHSTSVhost(vhost, collection))
 			httpsBuilder.AddFilterChain(httpsFilter)
 
-			// note that our redirect logic plays nice with paths, so ACME challenges should still work
-			httpFilter.ForVhost(createNewHTTPSRedirectVhost(vhost))
+			// ACME challenges and routes that opted out of the redirect are still served over plain HTTP
+			httpFilter.ForVhost(createNewHTTPSRedirectVhost(vhost, collection))
 		} else {
 			httpFilter.ForVhost(vhost)
 		}
 	}
 
+	if len(challengeDomains) > 0 && l.acmeIntegration.TLSALPN01ClusterName() != "" {
+		httpsBuilder.AddFilterChain(converting.NewFilterChainBuilder("acme_tls_alpn01").
+			ForTLSALPNChallenges(challengeDomains, l.acmeIntegration.TLSALPN01ClusterName()))
+	}
+
 	httpBuilder.AddFilterChain(httpFilter)
 	return httpBuilder.Build(), httpsBuilder.Build()
 }
 
-func (l *ListenerProvider) createFilterChainWithTLS(vhost *route.VirtualHost) *converting.FilterChainBuilder {
-	return converting.NewFilterChainBuilder(vhost.Name).EnableTLS(vhost.Domains, l.sdsProvider.GetCertificateConfig(vhost))
+func (l *ListenerProvider) createFilterChainWithTLS(vhost *route.VirtualHost, collection *converting.VhostCollection) *converting.FilterChainBuilder {
+	return l.newFilterChainBuilder(vhost.Name, collection).EnableTLS(vhost.Domains, l.sdsProvider.GetCertificateConfig(vhost))
 }
 
-func createNewHTTPSRedirectVhost(originalVhost *route.VirtualHost) *route.VirtualHost {
+// newFilterChainBuilder applies the HTTP filter settings that are shared by all filter chains
+func (l *ListenerProvider) newFilterChainBuilder(name string, collection *converting.VhostCollection) *converting.FilterChainBuilder {
+	builder := converting.NewFilterChainBuilder(name).
+		WithTrustedProxyHops(l.trustedProxyHops).
+		WithExternalAuthorizations(collection.ExternalAuthorizations()).
+		WithJWTProviders(collection.JWTProviders())
+	if l.rateLimitCluster != "" {
+		builder.WithRateLimitService(l.rateLimitDomain, l.rateLimitCluster)
+	}
+
+	return builder
+}
+
+// createNewHTTPSRedirectVhost replaces the routes of a vhost with redirects to HTTPS, except for ACME challenges and
+// routes that opted out of the redirect
+func createNewHTTPSRedirectVhost(originalVhost *route.VirtualHost, collection *converting.VhostCollection) *route.VirtualHost {
+	var routes, challenges []*route.Route
+	codes := map[uint32]bool{}
+	optedOut := false
+	for _, r := range originalVhost.Routes {
+		policy := collection.HTTPSPolicy(r.Name)
+		switch {
+		case r.Name == acme.HTTP01RouteName:
+			challenges = append(challenges, r)
+			routes = append(routes, r)
+		case !policy.Redirect:
+			optedOut = true
+			routes = append(routes, r)
+		default:
+			codes[policy.RedirectCode] = true
+			routes = append(routes, createHTTPSRedirectRoute(r.Name+"_https_redirect", r.GetMatch(), policy.RedirectCode))
+		}
+	}
+
+	// without exceptions or mixed redirect codes a single catch-all redirect will do
+	code := converting.NewServiceHTTPS().RedirectCode
+	if !optedOut && len(codes) <= 1 {
+		for c := range codes {
+			code = c
+		}
+
+		routes = challenges
+	}
+
+	// paths that no route matches are redirected as well, otherwise they would end up as a 404 over plain HTTP
+	routes = append(routes, createHTTPSRedirectRoute("https_redirect", &route.RouteMatch{
+		PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"},
+	}, code))
+
 	return &route.VirtualHost{
 		Name:    originalVhost.Name,
 		Domains: originalVhost.Domains,
-		Routes: []*route.Route{{
-			Name: "https_redirect",
-			Match: &route.RouteMatch{
-				PathSpecifier: &route.RouteMatch_Prefix{
-					Prefix: "/",
-				},
-			},
-			Action: &route.Route_Redirect{
-				Redirect: &route.RedirectAction{
-					SchemeRewriteSpecifier: &route.RedirectAction_HttpsRedirect{
-						HttpsRedirect: true,
-					},
+		Routes:  routes,
+	}
+}
+
+func createHTTPSRedirectRoute(name string, match *route.RouteMatch, code uint32) *route.Route {
+	responseCode := route.RedirectAction_MOVED_PERMANENTLY
+	if code == 308 {
+		responseCode = route.RedirectAction_PERMANENT_REDIRECT
+	}
+
+	return &route.Route{
+		Name:  name,
+		Match: match,
+		Action: &route.Route_Redirect{
+			Redirect: &route.RedirectAction{
+				SchemeRewriteSpecifier: &route.RedirectAction_HttpsRedirect{
+					HttpsRedirect: true,
 				},
+				ResponseCode: responseCode,
 			},
-		}},
+		},
+	}
+}
+
+// createNewHSTSVhost adds the Strict-Transport-Security header to routes served over HTTPS, the header has no
+// meaning over plain HTTP
+func createNewHSTSVhost(originalVhost *route.VirtualHost, collection *converting.VhostCollection) *route.VirtualHost {
+	vhost := proto.Clone(originalVhost).(*route.VirtualHost)
+	for _, r := range vhost.Routes {
+		hsts := collection.HTTPSPolicy(r.Name).HSTS
+		if hsts == "" {
+			continue
+		}
+
+		r.ResponseHeadersToAdd = append(r.ResponseHeadersToAdd, &core.HeaderValueOption{
+			Header:       &core.HeaderValue{Key: "strict-transport-security", Value: hsts},
+			AppendAction: core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
 	}
+
+	return vhost
 }
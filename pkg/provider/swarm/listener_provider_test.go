@@ -4,9 +4,15 @@ import (
 	"context"
 	"testing"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ratelimit/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
 	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/acme"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/provider/swarm/converting"
 	"github.com/stretchr/testify/assert"
 )
@@ -108,13 +114,111 @@ func TestListenerBuilder_createListenersFromMultiVhostsWithCerts(t *testing.T) {
 	assert.Len(t, httpsResult.GetFilterChains(), 3)
 }
 
+func TestListenerBuilder_createListenersFromVhostsProxiesTLSALPNChallenges(t *testing.T) {
+	integration := acme.NewIntegration(nil, "control_plane_acme", nil, &discardLogger{}).
+		WithTLSALPN01Challenge("control_plane_acme_tls")
+	subject := NewListenerProvider(nil, integration)
+	testcase := converting.NewVhostCollection()
+	testcase.Vhosts["somedomain.com"] = &route.VirtualHost{
+		Name:    "somedomain.com",
+		Domains: []string{"somedomain.com", "www.somedomain.com"},
+	}
+
+	_, httpsResult := subject.createListenersFromVhosts(testcase)
+
+	assert.Len(t, httpsResult.GetFilterChains(), 1)
+	match := httpsResult.GetFilterChains()[0].GetFilterChainMatch()
+	assert.Equal(t, []string{"somedomain.com", "www.somedomain.com"}, match.ServerNames)
+	assert.Equal(t, []string{converting.ACMETLSALPNProtocol}, match.ApplicationProtocols)
+	assert.Equal(t, wellknown.TCPProxy, httpsResult.GetFilterChains()[0].GetFilters()[0].Name)
+}
+
+func TestListenerBuilder_createListenersFromVhostsIssuesThroughDNS01(t *testing.T) {
+	integration := acme.NewIntegration(nil, "control_plane_acme", nil, &discardLogger{}).
+		WithTLSALPN01Challenge("control_plane_acme_tls").
+		WithDNS01Challenge()
+	subject := NewListenerProvider(nil, integration)
+	testcase := converting.NewVhostCollection()
+	testcase.Vhosts["internal.example.com"] = &route.VirtualHost{
+		Name:    "internal.example.com",
+		Domains: []string{"internal.example.com"},
+	}
+
+	httpResult, httpsResult := subject.createListenersFromVhosts(testcase)
+
+	// DNS-01 needs no challenge traffic at the edge, not even for regular domains
+	assert.Len(t, httpsResult.GetFilterChains(), 0)
+	assert.Len(t, httpResult.GetFilterChains(), 1)
+	assert.Empty(t, testcase.Vhosts["internal.example.com"].Routes)
+	assert.Equal(t, []string{"internal.example.com"}, testcase.Vhosts["internal.example.com"].Domains)
+}
+
+func TestListenerBuilder_createListenersFromVhostsOnlyProxiesChallengesOfIssuedVhosts(t *testing.T) {
+	integration := acme.NewIntegration(nil, "control_plane_acme", nil, &discardLogger{}).
+		WithTLSALPN01Challenge("control_plane_acme_tls")
+	subject := NewListenerProvider(nil, integration)
+	testcase := issuerCollection(t, "staging")
+	testcase.Vhosts["wildcard.com"] = &route.VirtualHost{
+		Name:    "wildcard.com",
+		Domains: []string{"wildcard.com", "*.wildcard.com"},
+	}
+
+	_, httpsResult := subject.createListenersFromVhosts(testcase)
+
+	// an unknown issuer and a wildcard without DNS-01 both skip issuing, so there are no challenges to answer
+	assert.Len(t, httpsResult.GetFilterChains(), 0)
+}
+
+// issuerCollection creates a single vhost for somedomain.com that uses the issuer for its certificate
+func issuerCollection(t *testing.T, issuer string) *converting.VhostCollection {
+	labels := converting.NewServiceLabel()
+	labels.Route.Domain = "somedomain.com"
+	labels.TLS.Issuer = issuer
+
+	collection := converting.NewVhostCollection()
+	assert.NoError(t, collection.AddService("somedomain", &labels))
+
+	return collection
+}
+
+func TestListenerBuilder_createListenersFromVhostsWithoutIssuerIsHTTPOnly(t *testing.T) {
+	subject := NewListenerProvider(&hasAllSDS{}, nil)
+
+	httpResult, httpsResult := subject.createListenersFromVhosts(issuerCollection(t, converting.TLSIssuerNone))
+
+	assert.Len(t, httpResult.GetFilterChains(), 1)
+	assert.Len(t, httpsResult.GetFilterChains(), 0)
+}
+
+func TestListenerBuilder_createListenersFromVhostsNeverIssuesManualCertificates(t *testing.T) {
+	integration := acme.NewIntegration(nil, "control_plane_acme", nil, &discardLogger{})
+	subject := NewListenerProvider(nil, integration)
+	collection := issuerCollection(t, converting.TLSIssuerManual)
+
+	subject.createListenersFromVhosts(collection)
+
+	assert.Len(t, collection.Vhosts["somedomain.com"].Routes, 1)
+	assert.False(t, integration.IsScheduledForIssuing(collection.Vhosts["somedomain.com"]))
+}
+
+func TestListenerBuilder_createListenersFromVhostsSkipsUnknownIssuers(t *testing.T) {
+	integration := acme.NewIntegration(nil, "control_plane_acme", nil, &discardLogger{})
+	subject := NewListenerProvider(nil, integration)
+	collection := issuerCollection(t, "staging")
+
+	subject.createListenersFromVhosts(collection)
+
+	assert.Len(t, collection.Vhosts["somedomain.com"].Routes, 1)
+	assert.Equal(t, []string{"somedomain.com"}, collection.Vhosts["somedomain.com"].Domains)
+}
+
 func Test_createHTTPSRedirectVhost(t *testing.T) {
 	originalVhost := &route.VirtualHost{
 		Name:    "orignal.com",
 		Domains: []string{"original.com", "www.original.com"},
 	}
 
-	redirectVhost := createNewHTTPSRedirectVhost(originalVhost)
+	redirectVhost := createNewHTTPSRedirectVhost(originalVhost, converting.NewVhostCollection())
 
 	assert.Equal(t, originalVhost.Name, redirectVhost.Name)
 	assert.Equal(t, originalVhost.Domains, redirectVhost.Domains)
@@ -124,3 +228,169 @@ func Test_createHTTPSRedirectVhost(t *testing.T) {
 	assert.Equal(t, &route.RouteMatch_Prefix{Prefix: "/"}, redirectVhost.Routes[0].Match.PathSpecifier)
 	assert.IsType(t, &route.Route_Redirect{}, redirectVhost.Routes[0].Action)
 }
+
+// httpsPolicyCollection creates a vhost with an api on /api, using the extra labels, and a frontend on /
+func httpsPolicyCollection(t *testing.T, api map[string]string) *converting.VhostCollection {
+	api["envoy.route.domain"] = "example.com"
+	api["envoy.route.path"] = "/api"
+
+	collection := converting.NewVhostCollection()
+	assert.NoError(t, collection.AddService("api", converting.ParseServiceLabels(api)[0]))
+	assert.NoError(t, collection.AddService("frontend", converting.ParseServiceLabels(map[string]string{
+		"envoy.route.domain": "example.com",
+	})[0]))
+
+	return collection
+}
+
+func Test_createHTTPSRedirectVhostKeepsAcmeChallenges(t *testing.T) {
+	collection := httpsPolicyCollection(t, map[string]string{})
+	vhost := collection.Vhosts["example.com"]
+	vhost.Routes = append([]*route.Route{{Name: acme.HTTP01RouteName}}, vhost.Routes...)
+
+	redirectVhost := createNewHTTPSRedirectVhost(vhost, collection)
+
+	assert.Len(t, redirectVhost.Routes, 2)
+	assert.Equal(t, acme.HTTP01RouteName, redirectVhost.Routes[0].Name)
+	assert.Equal(t, "https_redirect", redirectVhost.Routes[1].Name)
+}
+
+func Test_createHTTPSRedirectVhostKeepsRoutesThatOptedOut(t *testing.T) {
+	collection := httpsPolicyCollection(t, map[string]string{"envoy.route.https-redirect": "false"})
+
+	redirectVhost := createNewHTTPSRedirectVhost(collection.Vhosts["example.com"], collection)
+
+	assert.Len(t, redirectVhost.Routes, 3)
+	assert.IsType(t, &route.Route_Route{}, redirectVhost.Routes[0].Action)
+	assert.IsType(t, &route.Route_Redirect{}, redirectVhost.Routes[1].Action)
+	assert.Equal(t, &route.RouteMatch_Prefix{Prefix: "/"}, redirectVhost.Routes[1].Match.PathSpecifier)
+	assert.Equal(t, "https_redirect", redirectVhost.Routes[2].Name)
+}
+
+func Test_createHTTPSRedirectVhostUsesRedirectCodePerRoute(t *testing.T) {
+	collection := httpsPolicyCollection(t, map[string]string{"envoy.route.https-redirect-code": "308"})
+
+	redirectVhost := createNewHTTPSRedirectVhost(collection.Vhosts["example.com"], collection)
+
+	assert.Len(t, redirectVhost.Routes, 3)
+	assert.Equal(t, route.RedirectAction_PERMANENT_REDIRECT, redirectVhost.Routes[0].GetRedirect().ResponseCode)
+	assert.Equal(t, route.RedirectAction_MOVED_PERMANENTLY, redirectVhost.Routes[1].GetRedirect().ResponseCode)
+}
+
+func Test_createHTTPSRedirectVhostRedirectsUnmatchedPaths(t *testing.T) {
+	collection := converting.NewVhostCollection()
+	for name, labels := range map[string]map[string]string{
+		"api": {"envoy.route.path": "/api", "envoy.route.https-redirect-code": "308"},
+		"web": {"envoy.route.path": "/web"},
+	} {
+		labels["envoy.route.domain"] = "example.com"
+		assert.NoError(t, collection.AddService(name, converting.ParseServiceLabels(labels)[0]))
+	}
+
+	redirectVhost := createNewHTTPSRedirectVhost(collection.Vhosts["example.com"], collection)
+
+	// neither route matches /, so only the catch-all prevents a 404 over plain HTTP
+	assert.Len(t, redirectVhost.Routes, 3)
+	catchAll := redirectVhost.Routes[2]
+	assert.Equal(t, "https_redirect", catchAll.Name)
+	assert.Equal(t, &route.RouteMatch_Prefix{Prefix: "/"}, catchAll.Match.PathSpecifier)
+	assert.Equal(t, route.RedirectAction_MOVED_PERMANENTLY, catchAll.GetRedirect().ResponseCode)
+}
+
+func Test_createNewHSTSVhostOnlyAltersTheCopy(t *testing.T) {
+	collection := httpsPolicyCollection(t, map[string]string{"envoy.route.hsts": "max-age=31536000"})
+	vhost := collection.Vhosts["example.com"]
+
+	hstsVhost := createNewHSTSVhost(vhost, collection)
+
+	assert.Len(t, hstsVhost.Routes[0].ResponseHeadersToAdd, 1)
+	assert.Equal(t, "strict-transport-security", hstsVhost.Routes[0].ResponseHeadersToAdd[0].Header.Key)
+	assert.Empty(t, hstsVhost.Routes[1].ResponseHeadersToAdd)
+	assert.Empty(t, vhost.Routes[0].ResponseHeadersToAdd)
+}
+
+// httpFilterNames returns the names of the HTTP filters within the first filter chain of the listener
+func httpFilterNames(t *testing.T, l *listener.Listener) (names []string) {
+	manager := &hcm.HttpConnectionManager{}
+	assert.NoError(t, l.GetFilterChains()[0].GetFilters()[0].GetTypedConfig().UnmarshalTo(manager))
+
+	for _, filter := range manager.HttpFilters {
+		names = append(names, filter.Name)
+	}
+
+	return names
+}
+
+func TestListenerBuilder_createListenersWithoutRateLimitService(t *testing.T) {
+	subject := NewListenerProvider(nil, nil)
+	testcase := converting.NewVhostCollection()
+	testcase.Vhosts["somedomain.com"] = &route.VirtualHost{Name: "somedomain.com", Domains: []string{"somedomain.com"}}
+
+	httpResult, _ := subject.createListenersFromVhosts(testcase)
+
+	assert.NotContains(t, httpFilterNames(t, httpResult), wellknown.HTTPRateLimit)
+}
+
+func TestListenerBuilder_createListenersWithRateLimitService(t *testing.T) {
+	subject := NewListenerProvider(nil, nil).WithRateLimitService("envoy-swarm", "global_ratelimit")
+	testcase := converting.NewVhostCollection()
+	testcase.Vhosts["somedomain.com"] = &route.VirtualHost{Name: "somedomain.com", Domains: []string{"somedomain.com"}}
+
+	httpResult, _ := subject.createListenersFromVhosts(testcase)
+	names := httpFilterNames(t, httpResult)
+
+	assert.Contains(t, names, wellknown.HTTPRateLimit)
+	assert.Equal(t, wellknown.Router, names[len(names)-1])
+}
+
+func TestListenerBuilder_createListenersWithRateLimitServiceConfig(t *testing.T) {
+	subject := NewListenerProvider(nil, nil).WithRateLimitService("envoy-swarm", "global_ratelimit")
+	testcase := converting.NewVhostCollection()
+	testcase.Vhosts["somedomain.com"] = &route.VirtualHost{Name: "somedomain.com", Domains: []string{"somedomain.com"}}
+
+	httpResult, _ := subject.createListenersFromVhosts(testcase)
+	manager := &hcm.HttpConnectionManager{}
+	assert.NoError(t, httpResult.GetFilterChains()[0].GetFilters()[0].GetTypedConfig().UnmarshalTo(manager))
+
+	config := &ratelimit.RateLimit{}
+	for _, filter := range manager.HttpFilters {
+		if filter.Name == wellknown.HTTPRateLimit {
+			assert.NoError(t, filter.GetTypedConfig().UnmarshalTo(config))
+		}
+	}
+
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, "envoy-swarm", config.Domain)
+	assert.False(t, config.FailureModeDeny, "an outage of the ratelimit service should not reject every request")
+	assert.Equal(t, core.ApiVersion_V3, config.RateLimitService.TransportApiVersion)
+	assert.Equal(t, "global_ratelimit", config.RateLimitService.GrpcService.GetEnvoyGrpc().ClusterName)
+	assert.Positive(t, config.Timeout.AsDuration())
+}
+
+func TestListenerBuilder_createListenersWithExternalAuthorization(t *testing.T) {
+	subject := NewListenerProvider(nil, nil)
+	testcase := converting.NewVhostCollection()
+	labels := converting.NewServiceLabel()
+	labels.Route.Domain = "app.example.com"
+	labels.Route.ExtAuthz = converting.ServiceExtAuthz{Cluster: "sso-gateway", Mode: converting.ExtAuthzModeGRPC}
+	_ = testcase.AddService("app", &labels)
+
+	httpResult, _ := subject.createListenersFromVhosts(testcase)
+
+	assert.Contains(t, httpFilterNames(t, httpResult), "envoy.filters.http.ext_authz.grpc.sso-gateway")
+	assert.NoError(t, httpResult.Validate())
+}
+
+func TestListenerBuilder_createListenersWithJWTProviders(t *testing.T) {
+	subject := NewListenerProvider(nil, nil)
+	testcase := converting.NewVhostCollection()
+	labels := converting.NewServiceLabel()
+	labels.Route.Domain = "api.example.com"
+	labels.Route.JWT = converting.ServiceJWT{Issuer: "https://auth.example.com/", JwksURI: "https://auth.example.com/jwks.json"}
+	_ = testcase.AddService("api", &labels)
+
+	httpResult, _ := subject.createListenersFromVhosts(testcase)
+
+	assert.Contains(t, httpFilterNames(t, httpResult), converting.JWTAuthnFilterName)
+	assert.NoError(t, httpResult.Validate())
+}
@@ -3,102 +3,308 @@ package swarm
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	"github.com/docker/docker/api/types/swarm"
 
 	swarmtypes "github.com/docker/docker/api/types"
+	networktypes "github.com/docker/docker/api/types/network"
 	docker "github.com/docker/docker/client"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/client"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/logger"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/provider/swarm/converting"
 )
 
-// ADSProvider will convert swarm service definitions and labels into cluster, listener and route configuration for Envoy
+// ADSProvider will convert swarm service definitions and labels into cluster, endpoint, listener and route configuration for Envoy
 type ADSProvider struct {
-	ingressNetwork  string // the network name/id where our envoy communicates with services
-	dockerClient    docker.APIClient
-	listenerBuilder *ListenerProvider
-	logger          logger.Logger
+	ingressNetwork   string // the network name/id where our envoy communicates with services
+	dockerClient     docker.APIClient
+	endpointProvider *EndpointProvider
+	listenerBuilder  *ListenerProvider
+	staticClusters   []*cluster.Cluster // clusters that are not discovered through swarm, like a ratelimit service
+	jwksTrustedCA    string
+	logger           logger.Logger
 }
 
-func NewADSProvider(ingressNetwork string, builder *ListenerProvider, log logger.Logger) *ADSProvider {
+func NewADSProvider(ingressNetwork string, endpoints *EndpointProvider, builder *ListenerProvider, log logger.Logger) *ADSProvider {
 	return &ADSProvider{
-		dockerClient:    client.NewDockerClient(),
-		listenerBuilder: builder,
-		ingressNetwork:  ingressNetwork,
-		logger:          log,
+		dockerClient:     client.NewDockerClient(),
+		endpointProvider: endpoints,
+		listenerBuilder:  builder,
+		ingressNetwork:   ingressNetwork,
+		jwksTrustedCA:    converting.DefaultTrustedCA,
+		logger:           log,
 	}
 }
 
-func (s *ADSProvider) Provide(ctx context.Context) (clusters, listeners []types.Resource, err error) {
-	clusters, vhosts, err := s.provideClustersAndVhosts(ctx)
+// WithJWKSTrustedCA sets the CA bundle, as a path on the envoy instances, that the certificates of JWKS hosts are
+// verified with
+func (s *ADSProvider) WithJWKSTrustedCA(path string) *ADSProvider {
+	s.jwksTrustedCA = path
+
+	return s
+}
+
+// AddStaticCluster adds a cluster to every discovery cycle, swarm services can't use the same cluster name
+func (s *ADSProvider) AddStaticCluster(c *cluster.Cluster) *ADSProvider {
+	s.staticClusters = append(s.staticClusters, c)
+
+	return s
+}
+
+func (s *ADSProvider) Provide(ctx context.Context) (clusters, endpoints, listeners []types.Resource, err error) {
+	clusters, endpoints, vhosts, err := s.provideClustersAndVhosts(ctx)
 	if err != nil {
 		s.logger.Errorf("Failed creating clusters and vhost configurations")
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	listeners, err = s.listenerBuilder.ProvideListeners(vhosts)
 	if err != nil {
 		s.logger.Errorf("Failed converting the vhosts into a listener configuration")
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	return clusters, listeners, nil
+	return clusters, endpoints, listeners, nil
 }
 
 // provideClustersAndVhosts will break down swarm service definitions into clusters, endpoints and vhosts
-func (s *ADSProvider) provideClustersAndVhosts(ctx context.Context) (clusters []types.Resource, vhosts *converting.VhostCollection, err error) {
+func (s *ADSProvider) provideClustersAndVhosts(ctx context.Context) (clusters, endpoints []types.Resource, vhosts *converting.VhostCollection, err error) {
 	// Make sure we have up-to-date info about our ingress network
 	ingress, err := s.getIngressNetwork(ctx)
 	if err != nil {
-		return clusters, vhosts, err
+		return clusters, endpoints, vhosts, err
 	}
 
 	// Although introspecting by network makes more sense, I prefer debug output why we skipped a specific service
 	services, err := s.dockerClient.ServiceList(ctx, swarmtypes.ServiceListOptions{})
 	if err != nil {
-		return clusters, vhosts, err
+		return clusters, endpoints, vhosts, err
 	}
 
-	vhosts = converting.NewVhostCollection()
+	staticClusterNames := make(map[string]bool, len(s.staticClusters))
+	for _, c := range s.staticClusters {
+		staticClusterNames[c.Name] = true
+		clusters = append(clusters, c)
+	}
+
+	// Routes can refer to clusters of other services, so we'll collect all clusters before creating vhosts
+	var routables []routableCluster
 	for i := range services {
 		service := &services[i]
 		log := s.logger.WithFields(logger.Fields{"swarm-service-name": service.Spec.Name})
 
-		labels := converting.ParseServiceLabels(service.Spec.Labels)
-		if err = labels.Validate(); err != nil {
-			log.Debugf("skipping service because labels are invalid: %s", err.Error())
+		// A service can have multiple label groups, each group results in its own cluster
+		for _, labels := range converting.ParseServiceLabels(service.Spec.Labels) {
+			clusterName := labels.ClusterName(service.Spec.Name)
+			log := log.WithFields(logger.Fields{"cluster-name": clusterName})
+			if err = labels.Validate(); err != nil {
+				log.Debugf("skipping service because labels are invalid: %s", err.Error())
+				continue
+			}
+
+			if staticClusterNames[clusterName] {
+				log.Warnf("skipping service because its name is reserved for a cluster of the control plane")
+				continue
+			}
+
+			// Prevent confusion by filtering out services that are not properly connected
+			// Tasks will have no address to route to if a service is not connected to the shared ingress network
+			if !inIngressNetwork(service, &ingress) {
+				log.Warnf("service is not connected to the ingress network, stopping processing")
+				continue
+			}
+
+			cluster, err := converting.ServiceToCluster(service, labels)
+			if err != nil {
+				log.Warnf("skipped generating CDS for service because %s", err.Error())
+				continue
+			}
+
+			routables = append(routables, routableCluster{service: service, cluster: cluster, labels: labels, logger: log})
+		}
+	}
+
+	routables = withoutDuplicateClusterNames(routables)
+	routables = withoutJWKSClusterNames(routables)
+	resolveMirrors(routables)
+	http2Clusters := http2ClusterNames(routables)
+
+	endpoints, err = s.endpointProvider.ProvideEndpoints(ctx, ingress.ID, routables)
+	if err != nil {
+		return clusters, endpoints, vhosts, err
+	}
+
+	vhosts = converting.NewVhostCollection()
+	basicAuthConfigs := make(map[string][]byte)
+	for _, r := range routables {
+		// The cluster is kept even when the vhost is rejected, as routes of other services might mirror to it
+		clusters = append(clusters, r.cluster)
+
+		// A route that should be password protected is never exposed without its users
+		if err = s.loadBasicAuth(ctx, &r.labels.Route.BasicAuth, basicAuthConfigs); err != nil {
+			r.logger.Warnf("skipped creating vhost for service because %s", err.Error())
 			continue
 		}
 
-		// Prevent confusion by filtering out services that are not properly connected
-		// DNS requests will return empty responses if a service is not connected to the shared ingress network
-		if !inIngressNetwork(service, &ingress) {
-			log.Warnf("service is not connected to the ingress network, stopping processing")
+		// The same goes for routes that should be authorized by another service
+		if err = validateExtAuthz(r, http2Clusters); err != nil {
+			r.logger.Warnf("skipped creating vhost for service because %s", err.Error())
 			continue
 		}
 
-		cluster, err := converting.ServiceToCluster(service, labels)
-		if err != nil {
-			log.Warnf("skipped generating CDS for service because %s", err.Error())
+		// And for routes that would fetch their signing keys from somewhere else than the JWKS host
+		if jwksURI := r.labels.Route.JWT.JwksURI; jwksURI != "" && staticClusterNames[converting.JWKSClusterName(jwksURI)] {
+			r.logger.Warnf("skipped creating vhost for service because the JWKS cluster name is used by a cluster of the control plane")
 			continue
 		}
 
-		err = vhosts.AddService(cluster.Name, labels)
-		if err != nil {
-			log.Warnf("skipped creating vhost for service because %s", err.Error())
+		if err = vhosts.AddService(r.cluster.Name, r.labels); err != nil {
+			r.logger.Warnf("skipped creating vhost for service because %s", err.Error())
+		}
+	}
+
+	// Keys of JWT providers are fetched through clusters that are generated for each JWKS host
+	jwksClusters, err := vhosts.JWKSClusters(s.jwksTrustedCA)
+	if err != nil {
+		return clusters, endpoints, vhosts, err
+	}
+
+	for _, c := range jwksClusters {
+		clusters = append(clusters, c)
+	}
+
+	return clusters, endpoints, vhosts, nil
+}
+
+// routableCluster is a cluster with the service and labels it was created from
+type routableCluster struct {
+	service *swarm.Service
+	cluster *cluster.Cluster
+	labels  *converting.ServiceLabel
+	logger  logger.Logger
+}
+
+// http2ClusterNames tells for each cluster if it talks HTTP/2 to its upstream
+func http2ClusterNames(routables []routableCluster) map[string]bool {
+	names := make(map[string]bool, len(routables))
+	for i := range routables {
+		names[routables[i].cluster.Name] = routables[i].labels.Endpoint.HTTP2
+	}
+
+	return names
+}
+
+// validateExtAuthz makes sure the authorization service can be reached, every request would be denied otherwise
+func validateExtAuthz(r routableCluster, http2Clusters map[string]bool) error {
+	authz := r.labels.Route.ExtAuthz
+	if authz.Cluster == "" {
+		return nil
+	}
+
+	http2, exists := http2Clusters[authz.Cluster]
+	if !exists || authz.Cluster == r.cluster.Name {
+		return fmt.Errorf("route.ext-authz %s is not another service connected to the ingress network", authz.Cluster)
+	}
+
+	if authz.Mode == converting.ExtAuthzModeGRPC && !http2 {
+		return fmt.Errorf("route.ext-authz %s uses grpc mode but the service has no endpoint.http2 label", authz.Cluster)
+	}
+
+	return nil
+}
+
+func clusterNames(routables []routableCluster) map[string]bool {
+	names := make(map[string]bool, len(routables))
+	for i := range routables {
+		names[routables[i].cluster.Name] = true
+	}
+
+	return names
+}
+
+// withoutDuplicateClusterNames drops all services that end up with the same cluster name, a service named api_0 would
+// otherwise receive the traffic of the first label group of the api service or the other way around
+func withoutDuplicateClusterNames(routables []routableCluster) []routableCluster {
+	counts := make(map[string]int, len(routables))
+	for _, r := range routables {
+		counts[r.cluster.Name]++
+	}
+
+	kept := make([]routableCluster, 0, len(routables))
+	for _, r := range routables {
+		if counts[r.cluster.Name] > 1 {
+			r.logger.Warnf("skipping service because its cluster name is also used by another service or label group")
 			continue
 		}
 
-		clusters = append(clusters, cluster)
+		kept = append(kept, r)
+	}
+
+	return kept
+}
+
+// withoutJWKSClusterNames drops services that use the name of a generated JWKS cluster, envoy would otherwise fetch
+// the signing keys of JWT providers from these services
+func withoutJWKSClusterNames(routables []routableCluster) []routableCluster {
+	reserved := make(map[string]bool)
+	for _, r := range routables {
+		if r.labels.Route.JWT.JwksURI != "" {
+			reserved[converting.JWKSClusterName(r.labels.Route.JWT.JwksURI)] = true
+		}
+	}
+
+	kept := make([]routableCluster, 0, len(routables))
+	for _, r := range routables {
+		if reserved[r.cluster.Name] {
+			r.logger.Warnf("skipping service because its name is reserved for a JWKS cluster of the control plane")
+			continue
+		}
+
+		kept = append(kept, r)
+	}
+
+	return kept
+}
+
+// resolveMirrors will reject any route.mirror-to label that doesn't refer to another cluster of this discovery cycle
+func resolveMirrors(routables []routableCluster) {
+	knownClusters := clusterNames(routables)
+	for _, r := range routables {
+		mirror := r.labels.Route.Mirror.Cluster
+		if mirror == "" || (knownClusters[mirror] && mirror != r.cluster.Name) {
+			continue
+		}
+
+		r.logger.Warnf("ignoring route.mirror-to because %s is not another service connected to the ingress network", mirror)
+		r.labels.Route.Mirror.Cluster = ""
+	}
+}
+
+// loadBasicAuth reads the htpasswd file from the swarm config, configs are cached as services often share them
+func (s *ADSProvider) loadBasicAuth(ctx context.Context, basicAuth *converting.ServiceBasicAuth, cache map[string][]byte) error {
+	if basicAuth.Config == "" {
+		return nil
+	}
+
+	htpasswd, cached := cache[basicAuth.Config]
+	if !cached {
+		config, _, err := s.dockerClient.ConfigInspectWithRaw(ctx, basicAuth.Config)
+		if err != nil {
+			return fmt.Errorf("the route.basic-auth-config %s could not be loaded: %w", basicAuth.Config, err)
+		}
+
+		htpasswd = config.Spec.Data
+		cache[basicAuth.Config] = htpasswd
 	}
 
-	return clusters, vhosts, nil
+	return basicAuth.SetUsers(htpasswd)
 }
 
-func (s *ADSProvider) getIngressNetwork(ctx context.Context) (network swarmtypes.NetworkResource, err error) {
-	network, err = s.dockerClient.NetworkInspect(ctx, s.ingressNetwork, swarmtypes.NetworkInspectOptions{})
+func (s *ADSProvider) getIngressNetwork(ctx context.Context) (network networktypes.Inspect, err error) {
+	network, err = s.dockerClient.NetworkInspect(ctx, s.ingressNetwork, networktypes.InspectOptions{})
 	if err != nil {
 		return
 	}
@@ -110,7 +316,7 @@ func (s *ADSProvider) getIngressNetwork(ctx context.Context) (network swarmtypes
 	return
 }
 
-func inIngressNetwork(service *swarm.Service, ingress *swarmtypes.NetworkResource) bool {
+func inIngressNetwork(service *swarm.Service, ingress *networktypes.Inspect) bool {
 	for _, vip := range service.Endpoint.VirtualIPs {
 		if vip.NetworkID == ingress.ID {
 			return true
@@ -0,0 +1,101 @@
+package swarm
+
+import (
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/logger"
+	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/provider/swarm/converting"
+	"github.com/stretchr/testify/assert"
+)
+
+type discardLogger struct{}
+
+func (d *discardLogger) Debugf(_ string, _ ...interface{})        {}
+func (d *discardLogger) Infof(_ string, _ ...interface{})         {}
+func (d *discardLogger) Warnf(_ string, _ ...interface{})         {}
+func (d *discardLogger) Errorf(_ string, _ ...interface{})        {}
+func (d *discardLogger) Fatalf(_ string, _ ...interface{})        {}
+func (d *discardLogger) Panicf(_ string, _ ...interface{})        {}
+func (d *discardLogger) WithFields(_ logger.Fields) logger.Logger { return d }
+
+func createRoutable(clusterName, mirror string) routableCluster {
+	labels := converting.NewServiceLabel()
+	labels.Route.Mirror.Cluster = mirror
+
+	return routableCluster{
+		cluster: &cluster.Cluster{Name: clusterName},
+		labels:  &labels,
+		logger:  &discardLogger{},
+	}
+}
+
+func TestResolveMirrorsKeepsKnownClusters(t *testing.T) {
+	routables := []routableCluster{createRoutable("api", "api-next"), createRoutable("api-next", "")}
+
+	resolveMirrors(routables)
+
+	assert.Equal(t, "api-next", routables[0].labels.Route.Mirror.Cluster)
+}
+
+func TestResolveMirrorsRejectsUnknownClusters(t *testing.T) {
+	routables := []routableCluster{createRoutable("api", "not-on-the-ingress-network")}
+
+	resolveMirrors(routables)
+
+	assert.Equal(t, "", routables[0].labels.Route.Mirror.Cluster)
+}
+
+func TestResolveMirrorsRejectsMirroringToItself(t *testing.T) {
+	routables := []routableCluster{createRoutable("api", "api")}
+
+	resolveMirrors(routables)
+
+	assert.Equal(t, "", routables[0].labels.Route.Mirror.Cluster)
+}
+
+func TestServicesCantUseTheNameOfAJWKSCluster(t *testing.T) {
+	api := createRoutable("api", "")
+	api.labels.Route.JWT = converting.ServiceJWT{Issuer: "https://auth.example.com/", JwksURI: "https://auth.example.com/jwks.json"}
+	routables := []routableCluster{api, createRoutable("jwks_auth_example_com_443", "")}
+
+	routables = withoutJWKSClusterNames(routables)
+
+	assert.Len(t, routables, 1)
+	assert.Equal(t, "api", routables[0].cluster.Name)
+}
+
+func TestServicesCantShareAClusterName(t *testing.T) {
+	routables := []routableCluster{createRoutable("api_0", ""), createRoutable("web", ""), createRoutable("api_0", "")}
+
+	routables = withoutDuplicateClusterNames(routables)
+
+	assert.Len(t, routables, 1)
+	assert.Equal(t, "web", routables[0].cluster.Name)
+}
+
+func TestGRPCExtAuthzRequiresAnHTTP2Cluster(t *testing.T) {
+	api := createRoutable("api", "")
+	api.labels.Route.ExtAuthz = converting.ServiceExtAuthz{Cluster: "authorizer", Mode: converting.ExtAuthzModeGRPC}
+	authorizer := createRoutable("authorizer", "")
+
+	err := validateExtAuthz(api, http2ClusterNames([]routableCluster{api, authorizer}))
+	assert.EqualError(t, err, "route.ext-authz authorizer uses grpc mode but the service has no endpoint.http2 label")
+
+	authorizer.labels.Endpoint.HTTP2 = true
+	assert.NoError(t, validateExtAuthz(api, http2ClusterNames([]routableCluster{api, authorizer})))
+}
+
+func TestHTTPExtAuthzDoesNotRequireAnHTTP2Cluster(t *testing.T) {
+	api := createRoutable("api", "")
+	api.labels.Route.ExtAuthz = converting.ServiceExtAuthz{Cluster: "authorizer", Mode: converting.ExtAuthzModeHTTP}
+
+	assert.NoError(t, validateExtAuthz(api, http2ClusterNames([]routableCluster{api, createRoutable("authorizer", "")})))
+}
+
+func TestExtAuthzShouldBeAnotherService(t *testing.T) {
+	api := createRoutable("api", "")
+	api.labels.Route.ExtAuthz = converting.ServiceExtAuthz{Cluster: "api", Mode: converting.ExtAuthzModeHTTP}
+
+	assert.Error(t, validateExtAuthz(api, http2ClusterNames([]routableCluster{api})))
+}
@@ -29,5 +29,6 @@ func getCertificateFilename(primaryDomain string, sans []string) string {
 	hash := base64.StdEncoding.EncodeToString(sum[:])
 
 	// The result should be unique enough to prevent a unintended collisions, 16 characters seems unique enough
-	return strings.NewReplacer("/", "", "\\", "").Replace(fmt.Sprintf("%s-%s", filename, hash[:16]))
+	// Wildcards are written as an underscore, just like the lego CLI does
+	return strings.NewReplacer("/", "", "\\", "", "*", "_").Replace(fmt.Sprintf("%s-%s", filename, hash[:16]))
 }
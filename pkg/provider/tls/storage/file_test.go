@@ -59,3 +59,11 @@ func TestFileNameGeneratorCanHandleArrayIndexShifts(t *testing.T) {
 
 	assert.Equal(t, firstRun, getCertificateFilename("something.com", []string{"www.hello.co.uk", "hello.co.uk", "something.com"}))
 }
+
+func TestFileNameGeneratorReplacesWildcards(t *testing.T) {
+	domains := []string{"*.customers.example.com"}
+
+	fileName := getCertificateFilename(domains[0], domains)
+
+	assert.Equal(t, strings.HasPrefix(fileName, "_.customers.example.com-"), true)
+}
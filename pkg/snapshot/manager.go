@@ -2,6 +2,7 @@ package snapshot
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
@@ -17,6 +18,8 @@ type Manager struct {
 	sdsProvider   provider.SDS
 	snapshotCache cache.SnapshotCache
 	logger        logger.Logger
+	startedAt     time.Time
+	snapshots     uint64
 }
 
 func NewManager(ads provider.ADS, sds provider.SDS, c cache.SnapshotCache, log logger.Logger) *Manager {
@@ -25,6 +28,7 @@ func NewManager(ads provider.ADS, sds provider.SDS, c cache.SnapshotCache, log l
 		sdsProvider:   sds,
 		snapshotCache: c,
 		logger:        log,
+		startedAt:     time.Now(),
 	}
 }
 
@@ -44,7 +48,7 @@ func (d *Manager) runDiscovery(reason UpdateReason) error {
 	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
 	defer cancel()
 
-	clusters, listeners, err := d.adsProvider.Provide(ctx)
+	clusters, endpoints, listeners, err := d.adsProvider.Provide(ctx)
 	if err != nil {
 		return err
 	}
@@ -54,13 +58,13 @@ func (d *Manager) runDiscovery(reason UpdateReason) error {
 		return err
 	}
 
-	return d.createSnapshot(clusters, listeners, secrets)
+	return d.createSnapshot(clusters, endpoints, listeners, secrets)
 }
 
-func (d *Manager) createSnapshot(clusters, listeners, secrets []types.Resource) error {
-	version := time.Now().Format(time.RFC3339)
-	snap, err := cache.NewSnapshot(version, map[resource.Type][]types.Resource{
+func (d *Manager) createSnapshot(clusters, endpoints, listeners, secrets []types.Resource) error {
+	snap, err := cache.NewSnapshot(d.nextVersion(), map[resource.Type][]types.Resource{
 		resource.ClusterType:  clusters,
+		resource.EndpointType: endpoints,
 		resource.ListenerType: listeners,
 		resource.SecretType:   secrets,
 	})
@@ -77,7 +81,15 @@ func (d *Manager) createSnapshot(clusters, listeners, secrets []types.Resource)
 		return err
 	}
 
-	d.logger.WithFields(logger.Fields{"cluster-count": len(clusters), "listener-count": len(listeners), "secrets-count": len(secrets)}).Debugf("Updated snapshot")
+	d.logger.WithFields(logger.Fields{"cluster-count": len(clusters), "endpoint-count": len(endpoints), "listener-count": len(listeners), "secrets-count": len(secrets)}).Debugf("Updated snapshot")
 
 	return err
 }
+
+// nextVersion is unique for every snapshot, envoy won't receive a snapshot with the version it already acknowledged
+// The start time prevents reusing the versions of a previous run of the control plane
+func (d *Manager) nextVersion() string {
+	d.snapshots++
+
+	return fmt.Sprintf("%d-%d", d.startedAt.Unix(), d.snapshots)
+}
@@ -0,0 +1,36 @@
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/logger"
+	"gotest.tools/assert"
+)
+
+type discardLogger struct{}
+
+func (d *discardLogger) Debugf(_ string, _ ...interface{})        {}
+func (d *discardLogger) Infof(_ string, _ ...interface{})         {}
+func (d *discardLogger) Warnf(_ string, _ ...interface{})         {}
+func (d *discardLogger) Errorf(_ string, _ ...interface{})        {}
+func (d *discardLogger) Fatalf(_ string, _ ...interface{})        {}
+func (d *discardLogger) Panicf(_ string, _ ...interface{})        {}
+func (d *discardLogger) WithFields(_ logger.Fields) logger.Logger { return d }
+
+// Both snapshots are created within the same second, a timestamp as version would make envoy skip the second one
+func TestSnapshotsOfTheSameSecondHaveDifferentVersions(t *testing.T) {
+	snapshotCache := cache.NewSnapshotCache(true, StaticHash{}, nil)
+	manager := NewManager(nil, nil, snapshotCache, &discardLogger{})
+
+	assert.NilError(t, manager.createSnapshot(nil, nil, nil, nil))
+	first, err := snapshotCache.GetSnapshot(staticHash)
+	assert.NilError(t, err)
+
+	assert.NilError(t, manager.createSnapshot(nil, nil, nil, nil))
+	second, err := snapshotCache.GetSnapshot(staticHash)
+	assert.NilError(t, err)
+
+	assert.Assert(t, first.GetVersion(resource.ClusterType) != second.GetVersion(resource.ClusterType))
+}
@@ -3,7 +3,7 @@ package watcher
 import (
 	"context"
 
-	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	docker "github.com/docker/docker/client"
 	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/client"
@@ -21,21 +21,45 @@ func ForSwarmEvent(log logger.Logger) *SwarmEvent {
 }
 
 func (s SwarmEvent) Start(ctx context.Context, dispatchChannel chan snapshot.UpdateReason) {
-	events, errorEvent := s.client.Events(ctx, types.EventsOptions{
-		Filters: filters.NewArgs(filters.KeyValuePair{Key: "type", Value: "service"}),
+	// Container events are only emitted for the node we're running on, the SwarmTask watcher covers the remaining nodes
+	messages, errorEvent := s.client.Events(ctx, events.ListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", string(events.ServiceEventType)),
+			filters.Arg("type", string(events.ContainerEventType)),
+			filters.Arg("type", string(events.ConfigEventType)),
+		),
 	})
 
 	for {
 		select {
-		case event := <-events:
-			s.logger.WithFields(logger.Fields{"type": event.Type, "action": event.Action}).Debugf("received service event from docker")
-			if event.Action == "create" { // new services result in a created and updated event. Prevent unnecessary cycles
-				continue
+		case event := <-messages:
+			s.logger.WithFields(logger.Fields{"type": event.Type, "action": event.Action}).Debugf("received event from docker")
+			if reason, ok := updateReason(event); ok {
+				dispatchChannel <- reason
 			}
-			dispatchChannel <- "a swarm service changed"
 		case err := <-errorEvent:
 			s.logger.Errorf(err.Error())
 			s.Start(ctx, dispatchChannel) // Auto recover on errors @see github.com/docker/engine/docker/events.go:19
 		}
 	}
 }
+
+// updateReason filters out the events that won't change our configuration
+func updateReason(event events.Message) (snapshot.UpdateReason, bool) {
+	switch event.Type {
+	case events.ServiceEventType:
+		if event.Action == events.ActionCreate { // new services result in a created and updated event. Prevent unnecessary cycles
+			return "", false
+		}
+		return "a swarm service changed", true
+	case events.ContainerEventType:
+		if event.Action != events.ActionStart && event.Action != events.ActionDie {
+			return "", false
+		}
+		return "a swarm task started or stopped", true
+	case events.ConfigEventType:
+		return "a swarm config changed", true
+	}
+
+	return "", false
+}
@@ -0,0 +1,109 @@
+package watcher
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	swarmtypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	docker "github.com/docker/docker/client"
+	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/client"
+	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/logger"
+	"github.com/nstapelbroek/envoy-swarm-control-plane/pkg/snapshot"
+)
+
+// SwarmTask polls the running tasks of routed services, as docker has no events for tasks on other nodes
+// A change in the set of running tasks means the endpoints of a cluster have changed
+type SwarmTask struct {
+	client docker.APIClient
+	logger logger.Logger
+}
+
+func ForSwarmTask(log logger.Logger) *SwarmTask {
+	return &SwarmTask{client: client.NewDockerClient(), logger: log}
+}
+
+func (s *SwarmTask) Start(ctx context.Context, dispatchChannel chan snapshot.UpdateReason) {
+	const PollInterval = time.Second
+
+	lastState := ""
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			state, err := s.runningTasks(ctx)
+			if err != nil {
+				s.logger.Errorf(err.Error())
+				continue
+			}
+
+			// The first poll only sets a baseline, the initial startup event takes care of the first discovery
+			if lastState != "" && state != lastState {
+				dispatchChannel <- "the running swarm tasks changed"
+			}
+			lastState = state
+		case <-ctx.Done():
+			s.logger.Debugf("Stopping swarm task polling")
+			return
+		}
+	}
+}
+
+// runningTasks creates a comparable fingerprint of the tasks that are actually running for routed services
+func (s *SwarmTask) runningTasks(ctx context.Context) (string, error) {
+	running := []string{"-"} // never empty, so an empty swarm still differs from the initial state
+
+	serviceIDs, err := s.routedServices(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if len(serviceIDs) == 0 {
+		return running[0], nil
+	}
+
+	// Listing tasks of services that envoy won't route to is a waste of the managers' time
+	args := filters.NewArgs(filters.Arg("desired-state", string(swarm.TaskStateRunning)))
+	for _, id := range serviceIDs {
+		args.Add("service", id)
+	}
+
+	tasks, err := s.client.TaskList(ctx, swarmtypes.TaskListOptions{Filters: args})
+	if err != nil {
+		return "", err
+	}
+
+	for i := range tasks {
+		if tasks[i].Status.State == swarm.TaskStateRunning {
+			running = append(running, tasks[i].ID)
+		}
+	}
+	sort.Strings(running)
+
+	return strings.Join(running, ","), nil
+}
+
+// routedServices gives the IDs of services with envoy labels, the task list can't filter on a label prefix
+func (s *SwarmTask) routedServices(ctx context.Context) ([]string, error) {
+	services, err := s.client.ServiceList(ctx, swarmtypes.ServiceListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for i := range services {
+		for key := range services[i].Spec.Labels {
+			if strings.HasPrefix(key, "envoy.") {
+				ids = append(ids, services[i].ID)
+				break
+			}
+		}
+	}
+
+	return ids, nil
+}